@@ -0,0 +1,690 @@
+package netdef
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Change is one step taken by RenderedNetwork.Apply.
+type Change struct {
+	// Action is "add", "remove" or "update".
+	Action string
+	// Kind is what changed: "network", "patch", "router", "nat", "peer",
+	// "link" or "route".
+	Kind string
+	// Name identifies what changed. Links are named "peer/network" and
+	// routes "namespace dst".
+	Name string
+	// Detail describes the host resources involved, e.g. the interfaces,
+	// addresses and link options of a link.
+	Detail string
+}
+
+func (c Change) String() string {
+	if c.Detail == "" {
+		return fmt.Sprintf("%s %s %s", c.Action, c.Kind, c.Name)
+	}
+	return fmt.Sprintf("%s %s %s: %s", c.Action, c.Kind, c.Name, c.Detail)
+}
+
+// Apply reconciles r with cfg, usually an edited version of the Config r was
+// rendered from. Unchanged networks, peers, links, routers and NATs are left
+// alone, keeping their namespaces and addresses; the rest is removed, added or
+// updated in place. A peer whose BindMask changes, and everything attached to
+// a network whose ranges or bridge type change, is recreated.
+//
+// The changes made are returned in order. On failure, the changes made so far
+// are returned with the error and r describes what exists on the host. A
+// partition is lifted during the changes and put back on the remaining peers
+// afterwards, whether they succeed or not. Like Render, Apply holds the lock at
+// LockPath throughout.
+func (r *RenderedNetwork) Apply(cfg *Config) ([]Change, error) {
+	if r.Config == nil {
+		return nil, fmt.Errorf("rendered network does not record the config it was created from")
+	}
+
+	old, err := r.Config.validate()
+	if err != nil {
+		return nil, errors.Wrap(err, "recorded config")
+	}
+	p, err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkNaming(cfg); err != nil {
+		return nil, err
+	}
+
+	unlock, err := r.lockHost()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	r.restore(cfg)
+	a := &applier{
+		r:       r,
+		old:     old,
+		p:       p,
+		changed: make(map[string]bool),
+		flushed: make(map[string][]string),
+	}
+	err = a.apply()
+	return a.changes, err
+}
+
+// restore prepares r, which may have been loaded from disk, for changes made
+// with cfg: it takes cfg's prefixes and default bridge type and marks every
+// name r already uses as taken.
+func (r *RenderedNetwork) restore(cfg *Config) {
+	fresh := cfg.NewRenderedNetwork()
+	r.prefixes, r.bridge, r.naming = fresh.prefixes, fresh.bridge, fresh.naming
+	if r.ID == "" {
+		r.ID = fresh.ID
+	}
+
+	if r.Bridges == nil {
+		r.Bridges = make(map[string]struct{})
+	}
+	if r.Namespaces == nil {
+		r.Namespaces = make(map[string]string)
+	}
+	if r.Networks == nil {
+		r.Networks = make(map[string]string)
+	}
+	if r.Interfaces == nil {
+		r.Interfaces = make(map[string]struct{})
+	}
+
+	for name := range r.Bridges {
+		r.take(name)
+	}
+	for name := range r.Interfaces {
+		r.take(name)
+	}
+	for _, m := range []map[string]string{r.Namespaces, r.Routers, r.Nats} {
+		for _, ns := range m {
+			r.take(ns)
+		}
+	}
+	for _, m := range []map[string]map[string]*PeerLink{r.PeerLinks, r.RouterLinks, r.NatLinks} {
+		for _, links := range m {
+			for _, pl := range links {
+				r.take(pl.Interface)
+				r.take(pl.Port)
+			}
+		}
+	}
+	for _, pt := range r.Patches {
+		for _, port := range pt.Ports {
+			r.take(port)
+		}
+	}
+}
+
+// applier carries the state of one call to Apply.
+type applier struct {
+	r       *RenderedNetwork
+	old, p  *layout
+	changes []Change
+
+	// changed holds the networks whose bridges are removed, because they
+	// are gone from the new config or must be recreated.
+	changed map[string]bool
+	// flushed maps namespaces to the addresses of links removed from them.
+	// The kernel drops routes through those links along with them.
+	flushed map[string][]string
+}
+
+func (a *applier) record(action, kind, name, detail string) {
+	a.changes = append(a.changes, Change{Action: action, Kind: kind, Name: name, Detail: detail})
+}
+
+// apply makes the changes. A partition is lifted while they are made and put
+// back afterwards on the peers that are left, even if they fail.
+func (a *applier) apply() error {
+	r := a.r
+
+	groups := r.Partitions
+	if err := r.Heal(); err != nil {
+		return err
+	}
+	err := a.change()
+
+	groups = r.existingGroups(groups)
+	if len(groups) == 0 {
+		return err
+	}
+	if perr := r.Partition(groups...); perr != nil {
+		// Keep the partition recorded, so that Heal still removes what
+		// is left of it and it can be put back by applying again.
+		r.Partitions = groups
+		if err == nil {
+			return perr
+		}
+		return fmt.Errorf("%s (restoring partition: %s)", err, perr)
+	}
+	return err
+}
+
+// existingGroups returns groups without the peers r no longer has, and
+// without the groups left empty.
+func (r *RenderedNetwork) existingGroups(groups [][]string) [][]string {
+	var out [][]string
+	for _, g := range groups {
+		var kg []string
+		for _, peer := range g {
+			if _, ok := r.Namespaces[peer]; ok {
+				kg = append(kg, peer)
+			}
+		}
+		if len(kg) > 0 {
+			out = append(out, kg)
+		}
+	}
+	return out
+}
+
+// change removes, adds and updates what differs between the old and new
+// configs.
+func (a *applier) change() error {
+	r := a.r
+
+	oldRoutes := a.old.routes(r)
+
+	for name, on := range a.old.nets {
+		nn, ok := a.p.nets[name]
+		if !ok || !sameNetwork(on, nn) || a.old.bridgeType(name) != a.p.bridgeType(name) {
+			a.changed[name] = true
+		}
+	}
+
+	if err := a.remove(); err != nil {
+		return err
+	}
+	if err := a.keepAddrs(); err != nil {
+		return err
+	}
+	if err := a.p.assignAddrs(); err != nil {
+		return err
+	}
+	if err := a.add(); err != nil {
+		return err
+	}
+	if err := a.reroute(oldRoutes); err != nil {
+		return err
+	}
+
+	r.Config = a.p.cfg.clone()
+	return nil
+}
+
+// remove tears down everything in r that the new config changes or drops.
+func (a *applier) remove() error {
+	r := a.r
+
+	newPeers := make(map[string]Peer)
+	for _, peer := range a.p.cfg.Peers {
+		newPeers[peer.Name] = peer
+	}
+	for _, op := range a.old.cfg.Peers {
+		if _, ok := r.Namespaces[op.Name]; !ok {
+			continue
+		}
+
+		np, ok := newPeers[op.Name]
+		if !ok || np.BindMask != op.BindMask {
+			if err := a.removePeer(op.Name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, net := range sortedKeys(r.PeerLinks[op.Name]) {
+			nl, ok := np.Links[net]
+			if ok && !a.changed[net] && linkAddress(nl) == linkAddress(op.Links[net]) {
+				continue
+			}
+			if err := a.removeLink(op.Name, net); err != nil {
+				return err
+			}
+		}
+	}
+
+	newNats := make(map[string]*natLink)
+	for _, nl := range a.p.nats {
+		newNats[nl.network] = nl
+	}
+	for _, nl := range a.old.nats {
+		if _, ok := r.Nats[nl.network]; !ok {
+			continue
+		}
+		nn, ok := newNats[nl.network]
+		if ok && !a.changed[nl.network] && !a.changed[nl.upstream] && sameNat(nl.opts, nn.opts) {
+			continue
+		}
+		if err := a.removeNamespace("nat", nl.network, r.Nats, r.NatLinks); err != nil {
+			return err
+		}
+	}
+
+	newRouters := make(map[string]routedLink)
+	for _, rl := range a.p.routers {
+		newRouters[rl.name] = rl
+	}
+	for _, rl := range a.old.routers {
+		if _, ok := r.Routers[rl.name]; !ok {
+			continue
+		}
+		nr, ok := newRouters[rl.name]
+		if ok && !a.changed[rl.a] && !a.changed[rl.b] && sameLink(rl.opts, nr.opts) {
+			continue
+		}
+		if err := a.removeNamespace("router", rl.name, r.Routers, r.RouterLinks); err != nil {
+			return err
+		}
+	}
+
+	newPatches := a.p.patches()
+	for _, name := range sortedKeys(r.Patches) {
+		np, ok := newPatches[name]
+		if ok && !a.changed[np.a] && !a.changed[np.b] && sameLink(r.Patches[name].Link, np.opts) {
+			continue
+		}
+		if err := a.removePatch(name); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range sortedKeys(a.changed) {
+		br, ok := r.Networks[name]
+		if !ok {
+			continue
+		}
+		if err := r.DeleteBridge(br); err != nil {
+			return errors.Wrapf(err, "removing network %s", name)
+		}
+		delete(r.Networks, name)
+		a.record("remove", "network", name, "bridge "+br)
+	}
+	return nil
+}
+
+// removePeer deletes the links and namespace of a peer.
+func (a *applier) removePeer(peer string) error {
+	r := a.r
+	for _, net := range sortedKeys(r.PeerLinks[peer]) {
+		if err := r.detach(r.PeerLinks[peer][net]); err != nil {
+			return errors.Wrapf(err, "removing peer %s", peer)
+		}
+		delete(r.PeerLinks[peer], net)
+	}
+	ns := r.Namespaces[peer]
+	if err := r.DeleteNamespace(ns); err != nil {
+		return errors.Wrapf(err, "removing peer %s", peer)
+	}
+	delete(r.Namespaces, peer)
+	delete(r.PeerLinks, peer)
+	a.record("remove", "peer", peer, "namespace "+ns)
+	return nil
+}
+
+// removeLink disconnects a peer from a network.
+func (a *applier) removeLink(peer, network string) error {
+	r := a.r
+	pl := r.PeerLinks[peer][network]
+	if err := r.detach(pl); err != nil {
+		return errors.Wrapf(err, "removing link of %s to %s", peer, network)
+	}
+	delete(r.PeerLinks[peer], network)
+	a.flushed[pl.Namespace] = append(a.flushed[pl.Namespace], pl.Addrs...)
+	a.record("remove", "link", peer+"/"+network, pl.Port+" on "+pl.Bridge)
+	return nil
+}
+
+// removeNamespace deletes a router or NAT, given the maps that record it.
+func (a *applier) removeNamespace(kind, name string, namespaces map[string]string, links map[string]map[string]*PeerLink) error {
+	r := a.r
+	for _, net := range sortedKeys(links[name]) {
+		if err := r.detach(links[name][net]); err != nil {
+			return errors.Wrapf(err, "removing %s %s", kind, name)
+		}
+		delete(links[name], net)
+	}
+	ns := namespaces[name]
+	if err := r.DeleteNamespace(ns); err != nil {
+		return errors.Wrapf(err, "removing %s %s", kind, name)
+	}
+	delete(namespaces, name)
+	delete(links, name)
+	a.record("remove", kind, name, "namespace "+ns)
+	return nil
+}
+
+// removePatch disconnects two bridges patched together.
+func (a *applier) removePatch(name string) error {
+	r := a.r
+	pt := r.Patches[name]
+	for i, port := range pt.Ports {
+		if r.bridgeType(pt.Bridges[i]) != BridgeOVS {
+			continue
+		}
+		if err := r.BridgeRemovePort(pt.Bridges[i], port); err != nil {
+			return errors.Wrapf(err, "removing patch %s", name)
+		}
+	}
+	for _, port := range pt.Ports {
+		if _, ok := r.Interfaces[port]; !ok {
+			continue
+		}
+		if err := r.DeleteInterface(port); err != nil {
+			return errors.Wrapf(err, "removing patch %s", name)
+		}
+	}
+	delete(r.Patches, name)
+	a.record("remove", "patch", name, patchDetail(pt))
+	return nil
+}
+
+// detach removes a link's port from its bridge and deletes the veth pair.
+func (r *RenderedNetwork) detach(pl *PeerLink) error {
+	if r.bridgeType(pl.Bridge) == BridgeOVS {
+		if err := r.BridgeRemovePort(pl.Bridge, pl.Port); err != nil {
+			return err
+		}
+	}
+	return r.DeleteInterface(pl.Port)
+}
+
+// keepAddrs gives everything that survived remove its current addresses in the
+// new layout, so that they are not handed out again.
+func (a *applier) keepAddrs() error {
+	r := a.r
+	for _, peer := range a.p.cfg.Peers {
+		links, ok := r.PeerLinks[peer.Name]
+		if !ok {
+			continue
+		}
+		a.p.addrs[peer.Name] = make(map[string][]string)
+		for net, pl := range links {
+			if err := a.keep(net, pl.Addrs, "peer "+peer.Name); err != nil {
+				return err
+			}
+			a.p.addrs[peer.Name][net] = pl.Addrs
+		}
+	}
+
+	for _, rl := range a.p.routers {
+		links, ok := r.RouterLinks[rl.name]
+		if !ok {
+			continue
+		}
+		a.p.routerAddrs[rl.name] = make(map[string][]string)
+		for net, pl := range links {
+			if err := a.keep(net, pl.Addrs, "router "+rl.name); err != nil {
+				return err
+			}
+			a.p.routerAddrs[rl.name][net] = pl.Addrs
+		}
+	}
+
+	for _, nl := range a.p.nats {
+		links, ok := r.NatLinks[nl.network]
+		if !ok {
+			continue
+		}
+		nl.inside = links[nl.network].addrs()
+		nl.outside = links[nl.upstream].addrs()
+		if err := a.keep(nl.network, nl.inside, "NAT of "+nl.network); err != nil {
+			return err
+		}
+		if err := a.keep(nl.upstream, nl.outside, "NAT of "+nl.network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keep claims addresses in CIDR notation on a network of the new layout. The
+// gateway is already claimed by the network itself.
+func (a *applier) keep(network string, addrs []string, owner string) error {
+	n := a.p.nets[network]
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr)
+		if err != nil {
+			return err
+		}
+		if n.Gateway != "" && ip.Equal(net.ParseIP(n.Gateway)) {
+			continue
+		}
+		if err := n.claim(ip.String(), owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add creates everything in the new layout that r does not have yet, and
+// updates the options of links that changed.
+func (a *applier) add() error {
+	r := a.r
+
+	for _, name := range sortedKeys(a.p.nets) {
+		if _, ok := r.Networks[name]; ok {
+			continue
+		}
+		if err := r.createNetwork(name, a.p.bridgeType(name)); err != nil {
+			return err
+		}
+		a.record("add", "network", name, fmt.Sprintf("bridge %s (%s)", r.Networks[name], a.p.bridgeType(name)))
+	}
+
+	patches := a.p.patches()
+	for _, name := range sortedKeys(patches) {
+		if _, ok := r.Patches[name]; ok {
+			continue
+		}
+		pt := patches[name]
+		if err := r.createPatch(pt.a, pt.b, pt.opts); err != nil {
+			return err
+		}
+		a.record("add", "patch", name, patchDetail(r.Patches[name]))
+	}
+
+	var routers []routedLink
+	for _, rl := range a.p.routers {
+		if _, ok := r.Routers[rl.name]; !ok {
+			routers = append(routers, rl)
+		}
+	}
+	if err := r.createRouters(routers, a.p.routerAddrs); err != nil {
+		return err
+	}
+	for _, rl := range routers {
+		a.record("add", "router", rl.name, nsDetail(r.Routers[rl.name], r.RouterLinks[rl.name]))
+	}
+
+	var nats []*natLink
+	for _, nl := range a.p.nats {
+		if _, ok := r.Nats[nl.network]; !ok {
+			nats = append(nats, nl)
+		}
+	}
+	if err := r.createNats(nats); err != nil {
+		return err
+	}
+	for _, nl := range nats {
+		a.record("add", "nat", nl.network, nsDetail(r.Nats[nl.network], r.NatLinks[nl.network]))
+	}
+
+	for _, peer := range a.p.cfg.Peers {
+		if _, ok := r.Namespaces[peer.Name]; !ok {
+			if err := r.createPeer(peer, a.p.addrs[peer.Name]); err != nil {
+				return err
+			}
+			a.record("add", "peer", peer.Name, "namespace "+r.Namespaces[peer.Name])
+			for _, net := range sortedKeys(peer.Links) {
+				a.record("add", "link", peer.Name+"/"+net, linkDetail(r.PeerLinks[peer.Name][net]))
+			}
+			continue
+		}
+
+		for _, net := range sortedKeys(peer.Links) {
+			l := peer.Links[net]
+			pl, ok := r.PeerLinks[peer.Name][net]
+			switch {
+			case !ok:
+				if err := r.createPeerLink(peer.Name, net, a.p.addrs[peer.Name][net], l); err != nil {
+					return err
+				}
+				a.record("add", "link", peer.Name+"/"+net, linkDetail(r.PeerLinks[peer.Name][net]))
+			case !sameLink(pl.Link, l):
+				if err := r.UpdateLink(peer.Name, net, l); err != nil {
+					return err
+				}
+				a.record("update", "link", peer.Name+"/"+net, optsDetail(l))
+			}
+		}
+	}
+	return nil
+}
+
+// reroute brings the routes of every namespace from oldRoutes, the routes
+// needed by the old layout, to those needed by the new one.
+func (a *applier) reroute(oldRoutes map[string]map[string]string) error {
+	r := a.r
+	newRoutes := a.p.routes(r)
+
+	live := make(map[string]bool)
+	for _, m := range []map[string]string{r.Namespaces, r.Routers, r.Nats} {
+		for _, ns := range m {
+			live[ns] = true
+		}
+	}
+
+	for _, ns := range sortedKeys(oldRoutes) {
+		if !live[ns] {
+			continue
+		}
+		for _, dst := range sortedKeys(oldRoutes[ns]) {
+			via := oldRoutes[ns][dst]
+			if newRoutes[ns][dst] == via || a.isFlushed(ns, via) {
+				continue
+			}
+			if err := r.backend().DeleteRoute(ns, dst, via); err != nil {
+				return errors.Wrapf(err, "removing route to %s in %s", dst, ns)
+			}
+			a.record("remove", "route", ns+" "+dst, "via "+via)
+		}
+	}
+
+	for _, ns := range sortedKeys(newRoutes) {
+		for _, dst := range sortedKeys(newRoutes[ns]) {
+			via := newRoutes[ns][dst]
+			if oldRoutes[ns][dst] == via && !a.isFlushed(ns, via) {
+				continue
+			}
+			if err := r.backend().AddRoute(ns, dst, via); err != nil {
+				return errors.Wrapf(err, "adding route to %s in %s", dst, ns)
+			}
+			a.record("add", "route", ns+" "+dst, "via "+via)
+		}
+	}
+	return nil
+}
+
+// isFlushed reports whether a route in ns through via went away with a link
+// removed from ns.
+func (a *applier) isFlushed(ns, via string) bool {
+	ip := net.ParseIP(via)
+	for _, addr := range a.flushed[ns] {
+		if _, ipn, err := net.ParseCIDR(addr); err == nil && ipn.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkDetail describes the interfaces, addresses and options of a link.
+func linkDetail(pl *PeerLink) string {
+	d := fmt.Sprintf("%s in %s, %s on %s", pl.Interface, pl.Namespace, pl.Port, pl.Bridge)
+	if len(pl.Addrs) > 0 {
+		d += ", " + strings.Join(pl.Addrs, " ")
+	}
+	if !pl.Link.empty() {
+		d += ", " + pl.Link.String()
+	}
+	return d
+}
+
+// nsDetail describes a router or NAT namespace and its links.
+func nsDetail(ns string, links map[string]*PeerLink) string {
+	d := "namespace " + ns
+	for _, net := range sortedKeys(links) {
+		d += fmt.Sprintf("; %s: %s", net, linkDetail(links[net]))
+	}
+	return d
+}
+
+// patchDetail describes the ports of a patch.
+func patchDetail(pt *Patch) string {
+	var ports []string
+	for i, port := range pt.Ports {
+		ports = append(ports, port+" on "+pt.Bridges[i])
+	}
+	d := strings.Join(ports, ", ")
+	if !pt.Link.empty() {
+		d += ", " + pt.Link.String()
+	}
+	return d
+}
+
+// optsDetail describes the options of a link.
+func optsDetail(l *LinkOpts) string {
+	if l.empty() {
+		return "no link options"
+	}
+	return l.String()
+}
+
+// sameNetwork reports whether two Networks have the same bridge and address
+// configuration, ignoring their links and NATs.
+func sameNetwork(a, b *Network) bool {
+	x, y := *a, *b
+	x.Links, y.Links = nil, nil
+	x.Nat, y.Nat = nil, nil
+	x.Bridge, y.Bridge = "", ""
+	x.pool, y.pool = nil, nil
+	x.pool6, y.pool6 = nil, nil
+	return reflect.DeepEqual(x, y)
+}
+
+// sameNat reports whether two NatOpts configure the same NAT.
+func sameNat(a, b *NatOpts) bool {
+	return a.Upstream == b.Upstream && a.Type == b.Type && a.Hairpin == b.Hairpin && sameLink(a.Link, b.Link)
+}
+
+// sameLink reports whether two LinkOpts configure the same physical link
+// qualities. A nil LinkOpts has none.
+func sameLink(a, b *LinkOpts) bool {
+	var x, y LinkOpts
+	if a != nil {
+		x = *a
+	}
+	if b != nil {
+		y = *b
+	}
+	return x.Latency == y.Latency && x.Jitter == y.Jitter && x.Bandwidth == y.Bandwidth && x.PacketLoss == y.PacketLoss
+}
+
+// linkAddress returns the static address of a link, if any.
+func linkAddress(l *LinkOpts) string {
+	if l == nil {
+		return ""
+	}
+	return l.Address
+}
@@ -0,0 +1,180 @@
+package netdef
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// applyConfig returns a config with two networks and a peer on each, with the
+// peers given.
+func applyConfig(peers ...Peer) *Config {
+	cfg := testConfig()
+	cfg.Networks = []Network{
+		{Name: "lan", IpRange: "10.0.0.0/24"},
+		{Name: "wan", IpRange: "10.1.0.0/24"},
+	}
+	cfg.Peers = append([]Peer{
+		{Name: "a", Links: map[string]*LinkOpts{"lan": nil}},
+		{Name: "b", Links: map[string]*LinkOpts{"lan": {Latency: "10ms"}}},
+	}, peers...)
+	return cfg
+}
+
+func TestApply(t *testing.T) {
+	c := Peer{Name: "c", Links: map[string]*LinkOpts{"wan": nil}}
+
+	cases := []struct {
+		name    string
+		edit    func(cfg *Config)
+		changes []string
+		cmds    []string
+	}{
+		{
+			name: "unchanged",
+			edit: func(cfg *Config) {},
+		},
+		{
+			name: "link options",
+			edit: func(cfg *Config) {
+				cfg.Peers[1].Links["lan"] = &LinkOpts{Latency: "20ms"}
+			},
+			changes: []string{"update link b/lan: latency 20ms"},
+			cmds: []string{
+				"tc qdisc del dev ttap1 root",
+				"tc qdisc replace dev ttap1 root netem delay 20ms",
+			},
+		},
+		{
+			name: "peers replaced",
+			edit: func(cfg *Config) {
+				cfg.Peers = append(cfg.Peers[:2], Peer{Name: "d", Links: map[string]*LinkOpts{"lan": nil, "wan": nil}})
+			},
+			changes: []string{
+				"remove peer c: namespace tns2",
+				"add peer d: namespace tns3",
+				"add link d/lan: tveth3 in tns3, ttap3 on tbr0, 10.0.0.3/24",
+				"add link d/wan: tveth4 in tns3, ttap4 on tbr1, 10.1.0.1/24",
+			},
+		},
+		{
+			name: "network removed",
+			edit: func(cfg *Config) {
+				cfg.Networks = cfg.Networks[:1]
+				cfg.Peers = cfg.Peers[:2]
+			},
+			changes: []string{
+				"remove peer c: namespace tns2",
+				"remove network wan: bridge tbr1",
+			},
+			cmds: []string{
+				"ip link del ttap2",
+				"ip netns del tns2",
+				"ip link del tbr1 type bridge",
+			},
+		},
+	}
+	for _, tc := range cases {
+		r, _ := renderFake(t, applyConfig(c))
+
+		cfg := applyConfig(c)
+		tc.edit(cfg)
+		f := &fakeRunner{}
+		r.Runner = f
+		changes, err := r.Apply(cfg)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+
+		var got []string
+		for _, ch := range changes {
+			got = append(got, ch.String())
+		}
+		if !reflect.DeepEqual(got, tc.changes) {
+			t.Errorf("%s: got changes\n%q\nwant\n%q", tc.name, got, tc.changes)
+		}
+		if tc.cmds != nil && !reflect.DeepEqual(f.cmds, tc.cmds) {
+			t.Errorf("%s: got commands\n%q\nwant\n%q", tc.name, f.cmds, tc.cmds)
+		}
+		if len(tc.changes) == 0 && len(f.cmds) != 0 {
+			t.Errorf("%s: commands run without changes: %q", tc.name, f.cmds)
+		}
+
+		// Unchanged peers keep their namespaces.
+		if r.Namespaces["a"] != "tns0" {
+			t.Errorf("%s: peer a moved to namespace %s", tc.name, r.Namespaces["a"])
+		}
+	}
+}
+
+func TestApplyWithoutConfig(t *testing.T) {
+	r := &RenderedNetwork{}
+	if _, err := r.Apply(applyConfig()); err == nil {
+		t.Error("applied to a render without a config")
+	}
+}
+
+func TestApplyPartition(t *testing.T) {
+	c := Peer{Name: "c", Links: map[string]*LinkOpts{"wan": nil}}
+	d := Peer{Name: "d", Links: map[string]*LinkOpts{"lan": nil}}
+
+	cases := []struct {
+		name       string
+		cfg        *Config
+		fail       string
+		err        string
+		partitions [][]string
+		blackholes int
+	}{
+		{
+			name:       "peer removed",
+			cfg:        applyConfig(),
+			partitions: [][]string{{"a"}, {"b"}},
+			blackholes: 2,
+		},
+		{
+			name:       "failed",
+			cfg:        applyConfig(c, d),
+			fail:       "ip netns add",
+			err:        "failed",
+			partitions: [][]string{{"a"}, {"b", "c"}},
+			blackholes: 4,
+		},
+		{
+			name:       "partition not restored",
+			cfg:        applyConfig(c, d),
+			fail:       "ip netns exec tns1 ip route add blackhole",
+			err:        "partitioning b",
+			partitions: [][]string{{"a"}, {"b", "c"}},
+			blackholes: 3,
+		},
+	}
+	for _, tc := range cases {
+		r, _ := renderFake(t, applyConfig(c))
+		if err := r.Partition([]string{"a"}, []string{"b", "c"}); err != nil {
+			t.Fatal(err)
+		}
+
+		f := &fakeRunner{}
+		if tc.fail != "" {
+			f.fail = map[string]error{tc.fail: errors.New("failed")}
+		}
+		r.Runner = f
+		_, err := r.Apply(tc.cfg)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: %s", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: got error %v, want one containing %q", tc.name, err, tc.err)
+		}
+
+		if !reflect.DeepEqual(r.Partitions, tc.partitions) {
+			t.Errorf("%s: got partitions %v, want %v", tc.name, r.Partitions, tc.partitions)
+		}
+		if n := len(f.grep("route add blackhole")); n != tc.blackholes {
+			t.Errorf("%s: got %d blackhole routes added, want %d:\n%q", tc.name, n, tc.blackholes, f.cmds)
+		}
+	}
+}
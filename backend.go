@@ -0,0 +1,215 @@
+package netdef
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Backend performs the namespace, veth and address operations needed to
+// render a network. Bridges are managed separately.
+type Backend interface {
+	// AddNamespace creates a named network namespace.
+	AddNamespace(name string) error
+	// DeleteNamespace deletes a named network namespace.
+	DeleteNamespace(name string) error
+	// AddVeth creates a veth interface in the global namespace.
+	AddVeth(name string) error
+	// AddVethPair creates a pair of connected veth interfaces in the global
+	// namespace.
+	AddVethPair(a, b string) error
+	// DeleteLink deletes an interface in the global namespace.
+	DeleteLink(name string) error
+	// SetLinkNamespace moves an interface from the global namespace into a
+	// named namespace.
+	SetLinkNamespace(link, ns string) error
+	// SetLinkState sets an interface "up" or "down". An empty ns refers to
+	// the global namespace.
+	SetLinkState(ns, link, state string) error
+	// SetLinkMAC sets the hardware address of an interface in the global
+	// namespace.
+	SetLinkMAC(link, mac string) error
+	// AddAddr assigns an address in CIDR notation to an interface within a
+	// namespace.
+	AddAddr(ns, link, cidr string) error
+	// AddRoute adds a route to dst, in CIDR notation, through the gateway
+	// via within a namespace.
+	AddRoute(ns, dst, via string) error
+	// DeleteRoute removes a route added by AddRoute.
+	DeleteRoute(ns, dst, via string) error
+	// AddBlackhole adds a route that drops traffic to dst, in CIDR notation,
+	// within a namespace.
+	AddBlackhole(ns, dst string) error
+	// DeleteBlackhole removes a route added by AddBlackhole.
+	DeleteBlackhole(ns, dst string) error
+	// SetSysctl sets a sysctl, e.g. "net.ipv4.ip_forward", within a
+	// namespace.
+	SetSysctl(ns, key, val string) error
+	// VethNames lists the veth interfaces in the global namespace.
+	VethNames() ([]string, error)
+	// SetLinkAlias sets the alias of an interface in the global namespace.
+	SetLinkAlias(link, alias string) error
+	// LinkAliases maps the interfaces in the global namespace that have an
+	// alias to it.
+	LinkAliases() (map[string]string, error)
+}
+
+// IPBackend implements Backend by running the iproute2 `ip` binary.
+type IPBackend struct {
+	// Runner executes the commands. If nil, they are executed directly.
+	Runner Runner
+}
+
+func (b *IPBackend) run(args ...string) error {
+	return b.runner().Run(args...)
+}
+
+func (b *IPBackend) runner() Runner {
+	if b.Runner == nil {
+		return ExecRunner{}
+	}
+	return b.Runner
+}
+
+// AddNamespace runs `ip netns add`.
+func (b *IPBackend) AddNamespace(name string) error {
+	return b.run("ip", "netns", "add", name)
+}
+
+// DeleteNamespace runs `ip netns del`.
+func (b *IPBackend) DeleteNamespace(name string) error {
+	return b.run("ip", "netns", "del", name)
+}
+
+// AddVeth runs `ip link add` for a single veth.
+func (b *IPBackend) AddVeth(name string) error {
+	return b.run("ip", "link", "add", name, "type", "veth")
+}
+
+// AddVethPair runs `ip link add` for a veth pair.
+func (b *IPBackend) AddVethPair(a, c string) error {
+	return b.run("ip", "link", "add", a, "type", "veth", "peer", "name", c)
+}
+
+// DeleteLink runs `ip link del`.
+func (b *IPBackend) DeleteLink(name string) error {
+	return b.run("ip", "link", "del", name)
+}
+
+// SetLinkNamespace runs `ip link set netns`.
+func (b *IPBackend) SetLinkNamespace(link, ns string) error {
+	return b.run("ip", "link", "set", link, "netns", ns)
+}
+
+// SetLinkState runs `ip link set dev`, within ns if it is not empty.
+func (b *IPBackend) SetLinkState(ns, link, state string) error {
+	return b.run(inNamespace(ns, "ip", "link", "set", "dev", link, state)...)
+}
+
+// SetLinkMAC runs `ip link set address`.
+func (b *IPBackend) SetLinkMAC(link, mac string) error {
+	return b.run("ip", "link", "set", "dev", link, "address", mac)
+}
+
+// AddAddr runs `ip addr add` within ns. IPv6 addresses skip duplicate address
+// detection so that they are usable immediately.
+func (b *IPBackend) AddAddr(ns, link, cidr string) error {
+	if isIPv6(cidr) {
+		return b.run(inNamespace(ns, "ip", "-6", "addr", "add", cidr, "dev", link, "nodad")...)
+	}
+	return b.run(inNamespace(ns, "ip", "addr", "add", cidr, "dev", link)...)
+}
+
+// AddRoute runs `ip route add` within ns.
+func (b *IPBackend) AddRoute(ns, dst, via string) error {
+	return b.run(inNamespace(ns, routeCmd(dst, "add", dst, "via", via)...)...)
+}
+
+// DeleteRoute runs `ip route del` within ns.
+func (b *IPBackend) DeleteRoute(ns, dst, via string) error {
+	return b.run(inNamespace(ns, routeCmd(dst, "del", dst, "via", via)...)...)
+}
+
+// AddBlackhole runs `ip route add blackhole` within ns.
+func (b *IPBackend) AddBlackhole(ns, dst string) error {
+	return b.run(inNamespace(ns, routeCmd(dst, "add", "blackhole", dst)...)...)
+}
+
+// DeleteBlackhole runs `ip route del blackhole` within ns.
+func (b *IPBackend) DeleteBlackhole(ns, dst string) error {
+	return b.run(inNamespace(ns, routeCmd(dst, "del", "blackhole", dst)...)...)
+}
+
+// routeCmd returns an `ip route` command for the family of dst.
+func routeCmd(dst string, args ...string) []string {
+	if isIPv6(dst) {
+		return append([]string{"ip", "-6", "route"}, args...)
+	}
+	return append([]string{"ip", "route"}, args...)
+}
+
+// SetSysctl runs `sysctl -w` within ns.
+func (b *IPBackend) SetSysctl(ns, key, val string) error {
+	return b.run(inNamespace(ns, "sysctl", "-w", key+"="+val)...)
+}
+
+var vethRegexp = regexp.MustCompile(`^[0-9]+: ([a-z0-9]+)(@[a-z0-9]+)?:.+`)
+
+// SetLinkAlias runs `ip link set alias`.
+func (b *IPBackend) SetLinkAlias(link, alias string) error {
+	return b.run("ip", "link", "set", "dev", link, "alias", alias)
+}
+
+var aliasRegexp = regexp.MustCompile(`^[0-9]+: ([^:@ ]+)(@[^:]+)?:.*\\ +alias ([^\\]+)`)
+
+// LinkAliases parses the output of `ip -o link show`, which puts each
+// interface on one line with its alias last.
+func (b *IPBackend) LinkAliases() (map[string]string, error) {
+	out, err := b.runner().Output("ip", "-o", "link", "show")
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		match := aliasRegexp.FindStringSubmatch(scanner.Text())
+		if match != nil {
+			ret[match[1]] = strings.TrimSpace(match[3])
+		}
+	}
+	return ret, nil
+}
+
+// VethNames parses the output of `ip link show type veth`.
+func (b *IPBackend) VethNames() ([]string, error) {
+	out, err := b.runner().Output("ip", "link", "show", "type", "veth")
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewReader(out)
+	scanner := bufio.NewScanner(buf)
+	ret := make([]string, 0)
+	for scanner.Scan() {
+		match := vethRegexp.FindStringSubmatch(scanner.Text())
+		if match != nil {
+			ret = append(ret, match[1])
+		}
+	}
+	return ret, nil
+}
+
+// isIPv6 reports whether an address in CIDR notation is an IPv6 address.
+func isIPv6(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
+
+// inNamespace prefixes a command with `ip netns exec` if ns is not empty.
+func inNamespace(ns string, args ...string) []string {
+	if ns == "" {
+		return args
+	}
+	return append([]string{"ip", "netns", "exec", ns}, args...)
+}
@@ -0,0 +1,117 @@
+package netdef
+
+import (
+	"fmt"
+)
+
+// Bridge types understood by Config.Bridge and Network.Bridge.
+const (
+	// BridgeOVS bridges are managed by openvswitch. It is the default.
+	BridgeOVS = "ovs"
+	// BridgeLinux bridges are kernel bridges managed with iproute2.
+	BridgeLinux = "linux"
+)
+
+// BridgeDriver creates and manages one kind of bridge.
+type BridgeDriver interface {
+	// CreateBridge creates a bridge and brings it up.
+	CreateBridge(name string) error
+	// DeleteBridge deletes a bridge.
+	DeleteBridge(name string) error
+	// AddPort attaches an interface in the global namespace to a bridge.
+	AddPort(bridge, port string) error
+	// RemovePort detaches an interface from a bridge without deleting it.
+	RemovePort(bridge, port string) error
+}
+
+// OVSBridge is a BridgeDriver for openvswitch bridges.
+type OVSBridge struct {
+	// Runner executes ovs-vsctl. If nil, it is executed directly.
+	Runner Runner
+}
+
+// CreateBridge runs `ovs-vsctl add-br`.
+func (b *OVSBridge) CreateBridge(name string) error {
+	return runWith(b.Runner, "ovs-vsctl", "add-br", name)
+}
+
+// DeleteBridge runs `ovs-vsctl del-br`.
+func (b *OVSBridge) DeleteBridge(name string) error {
+	return runWith(b.Runner, "ovs-vsctl", "del-br", name)
+}
+
+// AddPort runs `ovs-vsctl add-port`.
+func (b *OVSBridge) AddPort(bridge, port string) error {
+	return runWith(b.Runner, "ovs-vsctl", "add-port", bridge, port)
+}
+
+// RemovePort runs `ovs-vsctl del-port`.
+func (b *OVSBridge) RemovePort(bridge, port string) error {
+	return runWith(b.Runner, "ovs-vsctl", "del-port", bridge, port)
+}
+
+// LinuxBridge is a BridgeDriver for kernel bridges, for hosts that cannot
+// run openvswitch.
+type LinuxBridge struct {
+	// Runner executes ip. If nil, it is executed directly.
+	Runner Runner
+}
+
+// CreateBridge runs `ip link add type bridge` and brings the bridge up.
+func (b *LinuxBridge) CreateBridge(name string) error {
+	if err := runWith(b.Runner, "ip", "link", "add", "name", name, "type", "bridge"); err != nil {
+		return err
+	}
+	return runWith(b.Runner, "ip", "link", "set", "dev", name, "up")
+}
+
+// DeleteBridge runs `ip link del`.
+func (b *LinuxBridge) DeleteBridge(name string) error {
+	return runWith(b.Runner, "ip", "link", "del", name, "type", "bridge")
+}
+
+// AddPort enslaves port to bridge with `ip link set master`.
+func (b *LinuxBridge) AddPort(bridge, port string) error {
+	return runWith(b.Runner, "ip", "link", "set", "dev", port, "master", bridge)
+}
+
+// RemovePort releases port from its bridge with `ip link set nomaster`.
+func (b *LinuxBridge) RemovePort(bridge, port string) error {
+	return runWith(b.Runner, "ip", "link", "set", "dev", port, "nomaster")
+}
+
+func runWith(run Runner, args ...string) error {
+	if run == nil {
+		run = ExecRunner{}
+	}
+	return run.Run(args...)
+}
+
+// validBridgeType returns an error if typ does not name a BridgeDriver. The
+// empty string selects the default.
+func validBridgeType(typ string) error {
+	switch typ {
+	case "", BridgeOVS, BridgeLinux:
+		return nil
+	default:
+		return fmt.Errorf("unknown bridge type %q", typ)
+	}
+}
+
+// bridgeDriver returns the driver for a bridge type.
+func (r *RenderedNetwork) bridgeDriver(typ string) BridgeDriver {
+	switch typ {
+	case BridgeLinux:
+		return &LinuxBridge{Runner: r.runner()}
+	default:
+		return &OVSBridge{Runner: r.runner()}
+	}
+}
+
+// bridgeType returns the type a bridge was created with.
+func (r *RenderedNetwork) bridgeType(bridge string) string {
+	if typ, ok := r.BridgeTypes[bridge]; ok {
+		return typ
+	}
+	return BridgeOVS
+}
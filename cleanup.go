@@ -0,0 +1,132 @@
+package netdef
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// CleanupError is returned by ForceCleanup and lists every resource that could
+// not be deleted.
+type CleanupError struct {
+	Errs []error
+}
+
+func (e *CleanupError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("failed to delete %d resources: %s", len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// Cleanup reverses the changes made by calling Create on a Config. It stops at
+// the first resource that cannot be deleted, which stays in r along with
+// everything not deleted yet. Resources that are already gone count as
+// deleted.
+func (r *RenderedNetwork) Cleanup() error {
+	return r.cleanup(false)
+}
+
+// ForceCleanup is like Cleanup, but attempts to delete every resource even if
+// some fail. It returns a *CleanupError listing the failures, if any, and r
+// keeps tracking only the resources that failed.
+func (r *RenderedNetwork) ForceCleanup() error {
+	return r.cleanup(true)
+}
+
+func (r *RenderedNetwork) cleanup(force bool) error {
+	var errs []error
+	fail := func(err error) bool {
+		errs = append(errs, err)
+		return !force
+	}
+
+	// Deleting a namespace deletes the veths in it, and with them their
+	// peers in the global namespace, so namespaces go first.
+	var namespaces []string
+	for _, m := range []map[string]string{r.Namespaces, r.Routers, r.Nats} {
+		for _, ns := range m {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		ports := r.portsInto(ns)
+		if err := r.DeleteNamespace(ns); err != nil {
+			if fail(errors.Wrapf(err, "namespace %s", ns)) {
+				return errs[0]
+			}
+			continue
+		}
+		for _, port := range ports {
+			delete(r.Interfaces, port)
+		}
+	}
+
+	for _, iface := range sortedKeys(r.Interfaces) {
+		if err := r.DeleteInterface(iface); err != nil {
+			if fail(errors.Wrapf(err, "interface %s", iface)) {
+				return errs[0]
+			}
+		}
+	}
+
+	for _, br := range sortedKeys(r.Bridges) {
+		if err := r.DeleteBridge(br); err != nil {
+			if fail(errors.Wrapf(err, "bridge %s", br)) {
+				return errs[0]
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return &CleanupError{Errs: errs}
+	}
+	return nil
+}
+
+// portsInto returns the ports of the links into namespace ns.
+func (r *RenderedNetwork) portsInto(ns string) []string {
+	var ports []string
+	for _, m := range []map[string]map[string]*PeerLink{r.PeerLinks, r.RouterLinks, r.NatLinks} {
+		for _, links := range m {
+			for _, pl := range links {
+				if pl.Namespace == ns {
+					ports = append(ports, pl.Port)
+				}
+			}
+		}
+	}
+	return ports
+}
+
+// isGone reports whether err, from deleting something, says that it does not
+// exist.
+func isGone(err error) bool {
+	if err == nil {
+		return false
+	}
+	// ESRCH is what deleting a missing route fails with.
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ESRCH) {
+		return true
+	}
+
+	msg := err.Error()
+	for _, s := range []string{
+		"Cannot find device",
+		"No such file or directory",
+		"no bridge named",
+		"no port named",
+		"Link not found",
+		"No such process",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package netdef
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestIsGone(t *testing.T) {
+	cases := []struct {
+		err  error
+		gone bool
+	}{
+		{nil, false},
+		{syscall.ENOENT, true},
+		{syscall.ENODEV, true},
+		{syscall.ESRCH, true},
+		{errors.Wrap(syscall.ENODEV, "deleting link"), true},
+		{&os.PathError{Op: "remove", Path: "/run/netns/tns0", Err: syscall.ENOENT}, true},
+		{fmt.Errorf(`Cannot find device "ttap0" (exit code 1)`), true},
+		{fmt.Errorf(`Cannot remove namespace file "/run/netns/tns0": No such file or directory (exit code 1)`), true},
+		{fmt.Errorf("ovs-vsctl: no bridge named br0 (exit code 1)"), true},
+		{fmt.Errorf("ovs-vsctl: no port named tap0 (exit code 1)"), true},
+		{fmt.Errorf("Link not found"), true},
+		{fmt.Errorf("RTNETLINK answers: No such process (exit code 2)"), true},
+		{syscall.EPERM, false},
+		{syscall.EBUSY, false},
+		{fmt.Errorf("RTNETLINK answers: Operation not permitted (exit code 2)"), false},
+		{fmt.Errorf("RTNETLINK answers: File exists (exit code 2)"), false},
+	}
+	for _, c := range cases {
+		if got := isGone(c.err); got != c.gone {
+			t.Errorf("isGone(%v): got %v, want %v", c.err, got, c.gone)
+		}
+	}
+}
+
+func TestForceCleanup(t *testing.T) {
+	cfg := testConfig()
+	cfg.Networks = []Network{{Name: "lan", IpRange: "10.0.0.0/24"}}
+	cfg.Peers = []Peer{
+		{Name: "a", Links: map[string]*LinkOpts{"lan": nil}},
+		{Name: "b", Links: map[string]*LinkOpts{"lan": nil}},
+		{Name: "c", Links: map[string]*LinkOpts{"lan": nil}},
+	}
+	fail := map[string]error{
+		"ip netns del tns0": errors.New("Cannot remove namespace file: Device or resource busy"),
+		"ip netns del tns1": errors.New("Cannot remove namespace file: No such file or directory"),
+	}
+
+	// Cleanup stops at the first failure.
+	r, _ := renderFake(t, cfg)
+	f := &fakeRunner{fail: fail}
+	r.Runner = f
+	if err := r.Cleanup(); err == nil {
+		t.Fatal("cleanup succeeded")
+	}
+	if want := []string{"ip netns del tns0"}; strings.Join(f.cmds, "\n") != strings.Join(want, "\n") {
+		t.Errorf("cleanup: got commands %q, want %q", f.cmds, want)
+	}
+
+	// ForceCleanup goes on, and counts tns1 as deleted since it is gone.
+	r, _ = renderFake(t, cfg)
+	f = &fakeRunner{fail: fail}
+	r.Runner = f
+	err := r.ForceCleanup()
+	ce, ok := err.(*CleanupError)
+	if !ok {
+		t.Fatalf("force cleanup: got error %v, want a *CleanupError", err)
+	}
+	if len(ce.Errs) != 1 || !strings.Contains(ce.Errs[0].Error(), "namespace tns0") {
+		t.Errorf("force cleanup: got failures %v, want only namespace tns0", ce.Errs)
+	}
+	want := []string{
+		"ip netns del tns0",
+		"ip netns del tns1",
+		"ip netns del tns2",
+		"ip link del ttap0",
+		"ip link del tbr0 type bridge",
+	}
+	if strings.Join(f.cmds, "\n") != strings.Join(want, "\n") {
+		t.Errorf("force cleanup: got commands\n%s\nwant\n%s", strings.Join(f.cmds, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Only what failed is left in r.
+	if len(r.Namespaces) != 1 || r.Namespaces["a"] != "tns0" {
+		t.Errorf("got namespaces %v left, want only tns0", r.Namespaces)
+	}
+	if len(r.Bridges) != 0 {
+		t.Errorf("got bridges %v left, want none", r.Bridges)
+	}
+}
@@ -0,0 +1,73 @@
+package netdef
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+// Namespace returns the namespace created for a peer.
+func (r *RenderedNetwork) Namespace(peer string) (string, error) {
+	ns, ok := r.Namespaces[peer]
+	if !ok {
+		return "", fmt.Errorf("no such peer: %s", peer)
+	}
+	return ns, nil
+}
+
+// Command returns an exec.Cmd that runs a program in the namespace of a peer.
+// Like exec.Command, it only prepares the command; the caller sets up its
+// standard streams and starts it. It is not run through r's Runner.
+func (r *RenderedNetwork) Command(peer, name string, args ...string) (*exec.Cmd, error) {
+	ns, err := r.Namespace(peer)
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command("ip", append([]string{"netns", "exec", ns, name}, args...)...), nil
+}
+
+// Do runs f on an OS thread switched into the namespace of a peer. Sockets
+// created by f stay in the namespace after Do returns. Goroutines started by f
+// run in the global namespace, and so does name resolution if it uses them, so
+// f should work with addresses rather than host names.
+func (r *RenderedNetwork) Do(peer string, f func() error) error {
+	ns, err := r.Namespace(peer)
+	if err != nil {
+		return err
+	}
+	return inNetns(ns, f)
+}
+
+// Dial connects to addr from the namespace of a peer, like net.Dial.
+func (r *RenderedNetwork) Dial(peer, network, addr string) (net.Conn, error) {
+	var c net.Conn
+	err := r.Do(peer, func() error {
+		var err error
+		c, err = net.Dial(network, addr)
+		return err
+	})
+	return c, err
+}
+
+// Listen listens on addr in the namespace of a peer, like net.Listen.
+func (r *RenderedNetwork) Listen(peer, network, addr string) (net.Listener, error) {
+	var l net.Listener
+	err := r.Do(peer, func() error {
+		var err error
+		l, err = net.Listen(network, addr)
+		return err
+	})
+	return l, err
+}
+
+// ListenPacket listens on addr in the namespace of a peer, like
+// net.ListenPacket.
+func (r *RenderedNetwork) ListenPacket(peer, network, addr string) (net.PacketConn, error) {
+	var c net.PacketConn
+	err := r.Do(peer, func() error {
+		var err error
+		c, err = net.ListenPacket(network, addr)
+		return err
+	})
+	return c, err
+}
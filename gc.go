@@ -0,0 +1,270 @@
+package netdef
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of resource found by a Collector.
+const (
+	// OwnedBridge is an openvswitch bridge.
+	OwnedBridge = "bridge"
+	// OwnedPort is a port of an openvswitch bridge.
+	OwnedPort = "port"
+	// OwnedLink is an interface in the global namespace, i.e. a veth or a
+	// kernel bridge.
+	OwnedLink = "link"
+	// OwnedNamespace is a namespace.
+	OwnedNamespace = "namespace"
+)
+
+// Owned is a resource on the host that is tagged as created by netdef.
+type Owned struct {
+	Kind string
+	Name string
+	// Owner is the ID of the RenderedNetwork that created it.
+	Owner string
+	// Created is when it was created.
+	Created time.Time
+}
+
+func (o Owned) String() string {
+	return fmt.Sprintf("%s %s (owner %s, created %s)", o.Kind, o.Name, o.Owner, o.Created.Format(time.RFC3339))
+}
+
+// Collector finds and deletes resources created by netdef that no longer
+// belong to a known RenderedNetwork, e.g. because its render was lost. Networks
+// whose render file is registered with RegisterRender and still exists are
+// always left alone.
+type Collector struct {
+	// Runner executes the commands that modify the host. If nil, commands
+	// are executed directly.
+	Runner Runner
+	// Backend manages namespaces and veths. If nil, an IPBackend using
+	// Runner is used.
+	Backend Backend
+	// Keep holds the IDs of further networks whose resources are left
+	// alone.
+	Keep map[string]bool
+	// Prefixes, if set, limits collection to resources whose name starts
+	// with one of them.
+	Prefixes []string
+	// MinAge, if set, limits collection to resources created at least this
+	// long ago.
+	MinAge time.Duration
+}
+
+func (c *Collector) runner() Runner {
+	if c.Runner == nil {
+		return ExecRunner{}
+	}
+	return c.Runner
+}
+
+func (c *Collector) backend() Backend {
+	if c.Backend == nil {
+		return &IPBackend{Runner: c.runner()}
+	}
+	return c.Backend
+}
+
+// Find lists the tagged resources on the host that would be collected.
+func (c *Collector) Find() ([]Owned, error) {
+	var found []Owned
+
+	aliases, err := c.backend().LinkAliases()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing interfaces")
+	}
+	for name, alias := range aliases {
+		found = appendOwned(found, OwnedLink, name, alias)
+	}
+
+	if _, err := exec.LookPath("ovs-vsctl"); err == nil {
+		for _, kind := range []string{OwnedBridge, OwnedPort} {
+			tags, err := c.ovsTags(kind)
+			if err != nil {
+				return nil, errors.Wrapf(err, "listing openvswitch %ss", kind)
+			}
+			for name, tag := range tags {
+				found = appendOwned(found, kind, name, tag)
+			}
+		}
+	}
+
+	markers, err := ioutil.ReadDir(MarkerDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "listing namespace markers")
+	}
+	for _, fi := range markers {
+		tag, err := os.Readlink(filepath.Join(MarkerDir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		found = appendOwned(found, OwnedNamespace, fi.Name(), tag)
+	}
+
+	live, err := LiveRenders()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing renders")
+	}
+	ret := found[:0]
+	for _, o := range found {
+		if !live[o.Owner] && c.collects(o) {
+			ret = append(ret, o)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Kind != ret[j].Kind {
+			return ret[i].Kind < ret[j].Kind
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// Collect deletes the resources Find lists. It keeps going past failures and
+// returns the resources it deleted along with a *CleanupError listing the
+// failures, if any.
+func (c *Collector) Collect() ([]Owned, error) {
+	found, err := c.Find()
+	if err != nil {
+		return nil, err
+	}
+
+	// As in Cleanup, namespaces go first since they take their veths with
+	// them, and openvswitch bridges go last. Kernel interfaces named after
+	// an openvswitch bridge belong to the bridge.
+	order := map[string]int{OwnedNamespace: 0, OwnedPort: 1, OwnedLink: 2, OwnedBridge: 3}
+	ovsBridges := make(map[string]bool)
+	for _, o := range found {
+		if o.Kind == OwnedBridge {
+			ovsBridges[o.Name] = true
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return order[found[i].Kind] < order[found[j].Kind]
+	})
+
+	var deleted []Owned
+	var errs []error
+	for _, o := range found {
+		if o.Kind == OwnedLink && ovsBridges[o.Name] {
+			continue
+		}
+		err := c.delete(o)
+		if isGone(err) {
+			err = nil
+		}
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "%s %s", o.Kind, o.Name))
+			continue
+		}
+		deleted = append(deleted, o)
+	}
+
+	if len(errs) > 0 {
+		return deleted, &CleanupError{Errs: errs}
+	}
+	return deleted, nil
+}
+
+func (c *Collector) delete(o Owned) error {
+	switch o.Kind {
+	case OwnedNamespace:
+		err := c.backend().DeleteNamespace(o.Name)
+		if err != nil && !isGone(err) {
+			return err
+		}
+		if !changesHost(c.runner(), c.Backend) {
+			return nil
+		}
+		return removeMarker(o.Name)
+	case OwnedPort:
+		return c.runner().Run("ovs-vsctl", "--if-exists", "del-port", o.Name)
+	case OwnedLink:
+		return c.backend().DeleteLink(o.Name)
+	case OwnedBridge:
+		return c.runner().Run("ovs-vsctl", "--if-exists", "del-br", o.Name)
+	}
+	return fmt.Errorf("unknown kind of resource: %s", o.Kind)
+}
+
+// collects reports whether o passes the filters of c.
+func (c *Collector) collects(o Owned) bool {
+	if c.Keep[o.Owner] {
+		return false
+	}
+	if c.MinAge > 0 && time.Since(o.Created) < c.MinAge {
+		return false
+	}
+	if len(c.Prefixes) == 0 {
+		return true
+	}
+	for _, p := range c.Prefixes {
+		if strings.HasPrefix(o.Name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ovsTags maps the openvswitch bridges or ports that have an owner tag to it.
+func (c *Collector) ovsTags(table string) (map[string]string, error) {
+	out, err := c.runner().Output("ovs-vsctl", "--format=csv", "--data=bare", "--no-headings",
+		"--columns=name,external_ids", "list", table)
+	if err != nil {
+		return nil, err
+	}
+	records, err := csv.NewReader(bytes.NewReader(out)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]string)
+	for _, rec := range records {
+		if len(rec) != 2 {
+			continue
+		}
+		for _, kv := range strings.Fields(rec[1]) {
+			if strings.HasPrefix(kv, ovsOwnerKey+"=") {
+				ret[rec[0]] = strings.TrimPrefix(kv, ovsOwnerKey+"=")
+			}
+		}
+	}
+	return ret, nil
+}
+
+// appendOwned appends a resource to found if tag is an owner tag.
+func appendOwned(found []Owned, kind, name, tag string) []Owned {
+	id, created, ok := parseOwnerTag(tag)
+	if !ok {
+		return found
+	}
+	return append(found, Owned{Kind: kind, Name: name, Owner: id, Created: created})
+}
+
+// NamePrefixes returns the prefixes of the names netdef generates for c,
+// sorted.
+func (c *Config) NamePrefixes() []string {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, p := range c.NewRenderedNetwork().prefixes {
+		if !seen[p] {
+			seen[p] = true
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,69 @@
+package netdef
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCollectorFind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netdef-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { MarkerDir = old }(MarkerDir)
+	MarkerDir = filepath.Join(dir, "netns")
+	defer func(old string) { RenderDir = old }(RenderDir)
+	RenderDir = filepath.Join(dir, "renders")
+
+	owners := map[string]string{
+		"tns0": "live",
+		"tns1": "creating",
+		"tns2": "lost",
+		"tns3": "kept",
+		"tns4": "unregistered",
+	}
+	for ns, id := range owners {
+		r := &RenderedNetwork{ID: id}
+		if err := r.markNamespace(ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The render of "live" exists, "creating" only has a journal so far and
+	// the render of "lost" is gone.
+	for id, file := range map[string]string{"live": "live.json", "creating": "creating.json.journal"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := RegisterRender(id, filepath.Join(dir, id+".json")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RegisterRender("lost", filepath.Join(dir, "lost.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	col := &Collector{Runner: &fakeRunner{}, Keep: map[string]bool{"kept": true}}
+	found, err := col.Find()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, o := range found {
+		got = append(got, o.Name)
+	}
+	if want := []string{"tns2", "tns4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v to collect, want %v", got, want)
+	}
+
+	if err := UnregisterRender("live"); err != nil {
+		t.Fatal(err)
+	}
+	if live, _ := LiveRenders(); live["live"] {
+		t.Error("unregistered render still live")
+	}
+}
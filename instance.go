@@ -0,0 +1,195 @@
+package netdef
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StateDir holds a directory for every named instance, which keeps its render
+// file and journal there.
+var StateDir = "/run/netdef/instances"
+
+// RenderDir holds a record of every render file written on the host, so that
+// gc can tell which networks are still in use. Each record is a symlink named
+// after the ID of a network that points at its render file.
+var RenderDir = "/run/netdef/renders"
+
+// Instance states reported by Instances.
+const (
+	// InstanceActive instances have a render file.
+	InstanceActive = "active"
+	// InstanceIncomplete instances have only a journal, because creating
+	// them failed or is still in progress.
+	InstanceIncomplete = "incomplete"
+)
+
+var instanceNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Instance describes a named network registered in StateDir.
+type Instance struct {
+	Name  string
+	State string
+	// ID is the ID of its RenderedNetwork, if known.
+	ID string
+	// Created is when it was created.
+	Created time.Time
+	// Peers and Networks count its peers and networks.
+	Peers    int
+	Networks int
+}
+
+// InstanceDir returns the directory of the named instance.
+func InstanceDir(name string) (string, error) {
+	if !instanceNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid instance name: %q", name)
+	}
+	return filepath.Join(StateDir, name), nil
+}
+
+// InstanceRender returns the path of the render file of the named instance.
+// Its journal is kept next to it.
+func InstanceRender(name string) (string, error) {
+	dir, err := InstanceDir(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "render.json"), nil
+}
+
+// Instances lists the instances registered in StateDir, sorted by name.
+func Instances() ([]Instance, error) {
+	dirs, err := ioutil.ReadDir(StateDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []Instance
+	for _, fi := range dirs {
+		if !fi.IsDir() || !instanceNameRegexp.MatchString(fi.Name()) {
+			continue
+		}
+		inst, err := readInstance(fi)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, inst)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+// readInstance describes the instance in the directory fi.
+func readInstance(fi os.FileInfo) (Instance, error) {
+	inst := Instance{Name: fi.Name(), State: InstanceIncomplete, Created: fi.ModTime()}
+	path, err := InstanceRender(fi.Name())
+	if err != nil {
+		return inst, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		inst.ID = journalID(path + ".journal")
+		return inst, nil
+	}
+	if err != nil {
+		return inst, err
+	}
+	defer f.Close()
+
+	var r RenderedNetwork
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return inst, fmt.Errorf("reading instance %s: %s", fi.Name(), err)
+	}
+	inst.State = InstanceActive
+	inst.ID = r.ID
+	if !r.Created.IsZero() {
+		inst.Created = r.Created
+	}
+	inst.Peers = len(r.Namespaces)
+	inst.Networks = len(r.Networks)
+	return inst, nil
+}
+
+// journalID returns the ID a journal was started with, or "" if it cannot be
+// read.
+func journalID(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	r, err := ReadJournal(f)
+	if err != nil {
+		return ""
+	}
+	return r.ID
+}
+
+// RegisterRender records that the render file of the network with the given
+// ID is at path. A Collector leaves the network alone for as long as the render
+// file or its journal exists there.
+func RegisterRender(id, path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(RenderDir, 0755); err != nil {
+		return errors.Wrap(err, "creating render directory")
+	}
+	link := filepath.Join(RenderDir, id)
+	if err := UnregisterRender(id); err != nil {
+		return err
+	}
+	return os.Symlink(abs, link)
+}
+
+// UnregisterRender removes the record RegisterRender made for the network with
+// the given ID, if any.
+func UnregisterRender(id string) error {
+	if id == "" {
+		return nil
+	}
+	err := os.Remove(filepath.Join(RenderDir, id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// LiveRenders returns the IDs of the registered networks whose render file or
+// journal still exists.
+func LiveRenders() (map[string]bool, error) {
+	links, err := ioutil.ReadDir(RenderDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]bool)
+	for _, fi := range links {
+		path, err := os.Readlink(filepath.Join(RenderDir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		for _, p := range []string{path, path + ".journal"} {
+			if _, err := os.Stat(p); err == nil {
+				ret[fi.Name()] = true
+			}
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,55 @@
+package netdef
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInstances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netdef-instances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { StateDir = old }(StateDir)
+	StateDir = dir
+
+	files := map[string]string{
+		"active/render.json":           `{"ID":"aaa","Namespaces":{"a":"tns0","b":"tns1"},"Networks":{"lan":"tbr0"}}`,
+		"active/render.json.journal":   `{"Op":"begin","ID":"aaa"}` + "\n",
+		"creating/render.json.journal": `{"Op":"begin","ID":"bbb"}` + "\n",
+		"failed/render.json.journal":   "",
+		"not an instance/render.json":  `{}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insts, err := Instances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Instance{
+		{Name: "active", State: InstanceActive, ID: "aaa", Peers: 2, Networks: 1},
+		{Name: "creating", State: InstanceIncomplete, ID: "bbb"},
+		{Name: "failed", State: InstanceIncomplete},
+	}
+	if len(insts) != len(want) {
+		t.Fatalf("got instances %v, want %v", insts, want)
+	}
+	for i, w := range want {
+		got := insts[i]
+		got.Created = w.Created
+		if got != w {
+			t.Errorf("got instance %+v, want %+v", got, w)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package netdef
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// addrRange is an inclusive range of addresses of one family.
+type addrRange struct {
+	lo, hi *big.Int
+	v4     bool
+}
+
+func (ar addrRange) contains(n *big.Int) bool {
+	return ar.lo.Cmp(n) <= 0 && n.Cmp(ar.hi) <= 0
+}
+
+// parseAddrRange parses a single address ("10.1.1.5"), a CIDR block
+// ("10.1.1.0/28") or an inclusive range ("10.1.1.10-10.1.1.20").
+func parseAddrRange(s string) (addrRange, error) {
+	if strings.Contains(s, "/") {
+		_, ipn, err := net.ParseCIDR(s)
+		if err != nil {
+			return addrRange{}, err
+		}
+		lo, hi := cidrBounds(ipn)
+		return addrRange{lo, hi, ipn.IP.To4() != nil}, nil
+	}
+
+	parts := strings.SplitN(s, "-", 2)
+	lo := net.ParseIP(strings.TrimSpace(parts[0]))
+	if lo == nil {
+		return addrRange{}, fmt.Errorf("invalid address %q", parts[0])
+	}
+	hi := lo
+	if len(parts) == 2 {
+		hi = net.ParseIP(strings.TrimSpace(parts[1]))
+		if hi == nil {
+			return addrRange{}, fmt.Errorf("invalid address %q", parts[1])
+		}
+		if (lo.To4() == nil) != (hi.To4() == nil) {
+			return addrRange{}, fmt.Errorf("range %q mixes address families", s)
+		}
+	}
+
+	ar := addrRange{ipToInt(lo), ipToInt(hi), lo.To4() != nil}
+	if ar.lo.Cmp(ar.hi) > 0 {
+		return addrRange{}, fmt.Errorf("range %q ends before it starts", s)
+	}
+	return ar, nil
+}
+
+// addrPool hands out the addresses of a single range, keeping track of which
+// have been assigned and to whom.
+type addrPool struct {
+	ipnet *net.IPNet
+	// first and last bound the assignable addresses, which exclude the
+	// network address and, for IPv4, the broadcast address.
+	first, last *big.Int
+	next        *big.Int
+
+	// reserved addresses are never handed out dynamically, but may be
+	// assigned statically.
+	reserved []addrRange
+	// excluded addresses are never assigned.
+	excluded []addrRange
+
+	used map[string]string
+}
+
+// newAddrPool creates a pool for the range ipnet.
+func newAddrPool(ipnet *net.IPNet, reserved, excluded []string) (*addrPool, error) {
+	lo, hi := cidrBounds(ipnet)
+	if hi.Cmp(lo) > 0 {
+		lo.Add(lo, big.NewInt(1))
+		if ipnet.IP.To4() != nil && hi.Cmp(lo) > 0 {
+			hi.Sub(hi, big.NewInt(1))
+		}
+	}
+
+	p := &addrPool{
+		ipnet: ipnet,
+		first: lo,
+		last:  hi,
+		next:  new(big.Int).Set(lo),
+		used:  make(map[string]string),
+	}
+
+	var err error
+	if p.reserved, err = p.parseRanges(reserved); err != nil {
+		return nil, err
+	}
+	if p.excluded, err = p.parseRanges(excluded); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseRanges parses the ranges that belong to this pool's address family.
+// Ranges of the other family belong to the other pool of a dual-stack network.
+func (p *addrPool) parseRanges(specs []string) ([]addrRange, error) {
+	var out []addrRange
+	for _, s := range specs {
+		ar, err := parseAddrRange(s)
+		if err != nil {
+			return nil, err
+		}
+		if ar.v4 != (p.ipnet.IP.To4() != nil) {
+			continue
+		}
+		out = append(out, ar)
+	}
+	return out, nil
+}
+
+func inRanges(ranges []addrRange, n *big.Int) bool {
+	_, ok := rangeAt(ranges, n)
+	return ok
+}
+
+// rangeAt returns the first of ranges that contains n.
+func rangeAt(ranges []addrRange, n *big.Int) (addrRange, bool) {
+	for _, ar := range ranges {
+		if ar.contains(n) {
+			return ar, true
+		}
+	}
+	return addrRange{}, false
+}
+
+// claim assigns a specific address to owner. Reserved addresses may be claimed,
+// excluded, out of range or already assigned addresses may not.
+func (p *addrPool) claim(ip net.IP, owner string) error {
+	if !p.ipnet.Contains(ip) {
+		return fmt.Errorf("address %s is outside of range %s", ip, p.ipnet)
+	}
+
+	n := ipToInt(ip)
+	if n.Cmp(p.first) < 0 || n.Cmp(p.last) > 0 {
+		return fmt.Errorf("address %s is not assignable in range %s", ip, p.ipnet)
+	}
+	if inRanges(p.excluded, n) {
+		return fmt.Errorf("address %s is excluded", ip)
+	}
+	if prev, ok := p.used[ip.String()]; ok {
+		return fmt.Errorf("address %s is already assigned to %s", ip, prev)
+	}
+
+	p.used[ip.String()] = owner
+	return nil
+}
+
+// allocate assigns the next free address to owner.
+func (p *addrPool) allocate(owner string) (net.IP, error) {
+	for ; p.next.Cmp(p.last) <= 0; p.next.Add(p.next, big.NewInt(1)) {
+		// Skip whole reserved and excluded ranges at once, since in IPv6
+		// they can be far too large to step through.
+		ar, ok := rangeAt(p.reserved, p.next)
+		if !ok {
+			ar, ok = rangeAt(p.excluded, p.next)
+		}
+		if ok {
+			p.next.Set(ar.hi)
+			continue
+		}
+
+		ip := intToIP(p.next, len(p.ipnet.IP))
+		if _, ok := p.used[ip.String()]; ok {
+			continue
+		}
+
+		p.used[ip.String()] = owner
+		p.next.Add(p.next, big.NewInt(1))
+		return ip, nil
+	}
+
+	return nil, fmt.Errorf("address range %s is exhausted", p.ipnet)
+}
+
+// format renders ip in CIDR notation. For IPv4 the first of mask and bindMask
+// that parses is used in place of the range's own mask.
+func (p *addrPool) format(ip net.IP, mask, bindMask string) string {
+	if ip.To4() == nil {
+		out := net.IPNet{
+			IP:   ip,
+			Mask: p.ipnet.Mask,
+		}
+		return out.String()
+	}
+
+	subnetMask := net.IPMask(net.ParseIP(mask))
+	if subnetMask == nil {
+		subnetMask = net.IPMask(net.ParseIP(bindMask))
+		if subnetMask == nil {
+			subnetMask = p.ipnet.Mask
+		}
+	}
+	out := net.IPNet{
+		IP:   ip.To16(),
+		Mask: subnetMask,
+	}
+	return out.String()
+}
+
+// cidrBounds returns the first and last addresses of ipnet.
+func cidrBounds(ipnet *net.IPNet) (*big.Int, *big.Int) {
+	ip := ipnet.IP.Mask(ipnet.Mask)
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^ipnet.Mask[i]
+	}
+	return ipToInt(ip), ipToInt(last)
+}
+
+// ipToInt converts an address to an integer. IPv4 addresses map to the 32 bit
+// range.
+func ipToInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return new(big.Int).SetBytes(ip)
+}
+
+// intToIP converts an integer back into an address of the given length.
+func intToIP(n *big.Int, length int) net.IP {
+	b := n.Bytes()
+	// Bytes drops leading zeros, pad back out to the address length.
+	return net.IP(append(make([]byte, length-len(b)), b...))
+}
+
+// initPools parses the Network's ranges into address pools and reserves its
+// gateway. It is safe to call more than once.
+func (n *Network) initPools() error {
+	if n.pool != nil {
+		return nil
+	}
+
+	_, ipn, err := net.ParseCIDR(n.IpRange)
+	if err != nil {
+		return err
+	}
+
+	pool, err := newAddrPool(ipn, n.Reserved, n.Exclude)
+	if err != nil {
+		return fmt.Errorf("network %s: %s", n.Name, err)
+	}
+
+	var pool6 *addrPool
+	if n.IpRange6 != "" {
+		if ipn.IP.To4() == nil {
+			return fmt.Errorf("network %s: IpRange must be IPv4 when IpRange6 is set", n.Name)
+		}
+
+		_, ipn6, err := net.ParseCIDR(n.IpRange6)
+		if err != nil {
+			return err
+		}
+		if ipn6.IP.To4() != nil {
+			return fmt.Errorf("network %s: IpRange6 %s is not an IPv6 range", n.Name, n.IpRange6)
+		}
+
+		pool6, err = newAddrPool(ipn6, n.Reserved, n.Exclude)
+		if err != nil {
+			return fmt.Errorf("network %s: %s", n.Name, err)
+		}
+	}
+
+	n.pool, n.pool6 = pool, pool6
+
+	if n.Gateway != "" {
+		if err := n.claim(n.Gateway, "the gateway"); err != nil {
+			n.pool, n.pool6 = nil, nil
+			return err
+		}
+	}
+	return nil
+}
+
+// poolFor returns the pool of the Network that holds addresses of ip's family.
+func (n *Network) poolFor(ip net.IP) *addrPool {
+	if (ip.To4() != nil) == (n.pool.ipnet.IP.To4() != nil) {
+		return n.pool
+	}
+	return n.pool6
+}
+
+// claim statically assigns addr to owner.
+func (n *Network) claim(addr, owner string) error {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("network %s: invalid address %q for %s", n.Name, addr, owner)
+	}
+
+	pool := n.poolFor(ip)
+	if pool == nil {
+		return fmt.Errorf("network %s: no range for address %s of %s", n.Name, addr, owner)
+	}
+	if err := pool.claim(ip, owner); err != nil {
+		return fmt.Errorf("network %s: assigning to %s: %s", n.Name, owner, err)
+	}
+	return nil
+}
+
+// assign returns one address in CIDR notation from each of the Network's
+// ranges for owner. If static is set it is used for the range of its family,
+// and must already have been claimed.
+func (n *Network) assign(owner, static, mask string) ([]string, error) {
+	if err := n.initPools(); err != nil {
+		return nil, err
+	}
+
+	var staticIP net.IP
+	if static != "" {
+		staticIP = net.ParseIP(static)
+	}
+
+	var out []string
+	for _, pool := range []*addrPool{n.pool, n.pool6} {
+		if pool == nil {
+			continue
+		}
+
+		ip := staticIP
+		if ip == nil || n.poolFor(ip) != pool {
+			var err error
+			ip, err = pool.allocate(owner)
+			if err != nil {
+				return nil, fmt.Errorf("network %s: assigning to %s: %s", n.Name, owner, err)
+			}
+		}
+		out = append(out, pool.format(ip, mask, n.BindMask))
+	}
+	return out, nil
+}
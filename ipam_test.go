@@ -0,0 +1,160 @@
+package netdef
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseAddrRange(t *testing.T) {
+	cases := []struct {
+		in     string
+		lo, hi string
+		err    string
+	}{
+		{in: "10.1.1.5", lo: "10.1.1.5", hi: "10.1.1.5"},
+		{in: "10.1.1.0/28", lo: "10.1.1.0", hi: "10.1.1.15"},
+		{in: "10.1.1.10 - 10.1.1.20", lo: "10.1.1.10", hi: "10.1.1.20"},
+		{in: "fd00::/96", lo: "fd00::", hi: "fd00::ffff:ffff"},
+		{in: "10.1.1.20-10.1.1.10", err: "ends before it starts"},
+		{in: "10.1.1.1-fd00::1", err: "mixes address families"},
+		{in: "10.1.1", err: "invalid address"},
+		{in: "10.1.1.0/33", err: "invalid CIDR"},
+	}
+	for _, c := range cases {
+		ar, err := parseAddrRange(c.in)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: got error %v, want one containing %q", c.in, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", c.in, err)
+			continue
+		}
+		if lo := ipToInt(net.ParseIP(c.lo)); ar.lo.Cmp(lo) != 0 {
+			t.Errorf("%q: got low end %s, want %s", c.in, ar.lo, c.lo)
+		}
+		if hi := ipToInt(net.ParseIP(c.hi)); ar.hi.Cmp(hi) != 0 {
+			t.Errorf("%q: got high end %s, want %s", c.in, ar.hi, c.hi)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	cases := []struct {
+		name     string
+		ipRange  string
+		reserved []string
+		exclude  []string
+		claim    []string
+		n        int
+		want     []string
+		err      string
+	}{
+		{
+			name:    "sequential",
+			ipRange: "10.0.0.0/29",
+			n:       3,
+			want:    []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		},
+		{
+			name:     "reserved and excluded",
+			ipRange:  "10.0.0.0/28",
+			reserved: []string{"10.0.0.1-10.0.0.2"},
+			exclude:  []string{"10.0.0.4/31"},
+			n:        3,
+			want:     []string{"10.0.0.3", "10.0.0.6", "10.0.0.7"},
+		},
+		{
+			name:    "claimed",
+			ipRange: "10.0.0.0/29",
+			claim:   []string{"10.0.0.1", "10.0.0.3"},
+			n:       2,
+			want:    []string{"10.0.0.2", "10.0.0.4"},
+		},
+		{
+			name:    "exhausted",
+			ipRange: "10.0.0.0/30",
+			n:       3,
+			want:    []string{"10.0.0.1", "10.0.0.2"},
+			err:     "exhausted",
+		},
+		{
+			name:     "large IPv6 ranges",
+			ipRange:  "fd00::/64",
+			reserved: []string{"fd00::/96"},
+			exclude:  []string{"fd00::1:0:0/100"},
+			n:        2,
+			want:     []string{"fd00::1:1000:0", "fd00::1:1000:1"},
+		},
+		{
+			name:    "IPv6 keeps the last address",
+			ipRange: "fd00::/126",
+			n:       4,
+			want:    []string{"fd00::1", "fd00::2", "fd00::3"},
+			err:     "exhausted",
+		},
+	}
+	for _, c := range cases {
+		_, ipn, err := net.ParseCIDR(c.ipRange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := newAddrPool(ipn, c.reserved, c.exclude)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		for _, a := range c.claim {
+			if err := p.claim(net.ParseIP(a), "static"); err != nil {
+				t.Errorf("%s: claiming %s: %s", c.name, a, err)
+			}
+		}
+
+		var got []string
+		for i := 0; i < c.n; i++ {
+			ip, err := p.allocate("test")
+			if err != nil {
+				if c.err == "" || !strings.Contains(err.Error(), c.err) {
+					t.Errorf("%s: got error %v, want %q", c.name, err, c.err)
+				}
+				break
+			}
+			got = append(got, ip.String())
+		}
+		if strings.Join(got, " ") != strings.Join(c.want, " ") {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestClaim(t *testing.T) {
+	_, ipn, _ := net.ParseCIDR("10.0.0.0/29")
+	p, err := newAddrPool(ipn, []string{"10.0.0.2"}, []string{"10.0.0.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		addr string
+		err  string
+	}{
+		{"10.0.0.2", ""},
+		{"10.0.0.2", "already assigned to static"},
+		{"10.0.0.3", "excluded"},
+		{"10.0.0.0", "not assignable"},
+		{"10.0.0.7", "not assignable"},
+		{"10.0.1.1", "outside of range"},
+	}
+	for _, c := range cases {
+		err := p.claim(net.ParseIP(c.addr), "static")
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("claiming %s: %s", c.addr, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("claiming %s: got error %v, want one containing %q", c.addr, err, c.err)
+		}
+	}
+}
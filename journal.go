@@ -0,0 +1,172 @@
+package netdef
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Journal operations.
+const (
+	opCreate = "create"
+	opDelete = "delete"
+	opMove   = "move"
+	// opBegin starts the journal of a network and records its ID.
+	opBegin = "begin"
+)
+
+// journalEntry is a line of a journal.
+type journalEntry struct {
+	Op   string
+	Kind string
+	Name string
+	Peer string `json:",omitempty"`
+	Type string `json:",omitempty"`
+	// Namespace is where a veth was moved to.
+	Namespace string `json:",omitempty"`
+	// ID is the ID of the network, for opBegin.
+	ID string `json:",omitempty"`
+}
+
+// syncer is implemented by journals that can be flushed to stable storage,
+// such as *os.File.
+type syncer interface {
+	Sync() error
+}
+
+// journal appends an entry for res to r.Journal, if set, and flushes it.
+func (r *RenderedNetwork) journal(op string, res resource, ns string) error {
+	return r.writeJournal(journalEntry{
+		Op:        op,
+		Kind:      res.Kind,
+		Name:      res.Name,
+		Peer:      res.Peer,
+		Type:      res.Type,
+		Namespace: ns,
+	})
+}
+
+// journalBegin records r's ID in r.Journal, if set, before anything is
+// created, so that whatever is tagged with it can be traced to the journal.
+func (r *RenderedNetwork) journalBegin() error {
+	return r.writeJournal(journalEntry{Op: opBegin, ID: r.ID})
+}
+
+// writeJournal appends e to r.Journal, if set, and flushes it.
+func (r *RenderedNetwork) writeJournal(e journalEntry) error {
+	if r.Journal == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// Write each entry at once, so that a crash leaves at most the last
+	// line incomplete.
+	if _, err := r.Journal.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "writing journal")
+	}
+	if s, ok := r.Journal.(syncer); ok {
+		if err := s.Sync(); err != nil {
+			return errors.Wrap(err, "syncing journal")
+		}
+	}
+	return nil
+}
+
+// ReadJournal rebuilds a RenderedNetwork from a journal, tracking every
+// bridge, namespace and veth that was created and not deleted since, and the ID
+// the journal was started with. Calling
+// Cleanup or Rollback on it deletes them. Namespaces are mapped to themselves in
+// Namespaces, as the journal does not record whom they were created for. An
+// incomplete last line, left by a crash, is ignored.
+func ReadJournal(rd io.Reader) (*RenderedNetwork, error) {
+	r := &RenderedNetwork{}
+	if err := r.ReplayJournal(rd); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ReplayJournal updates r, usually read from a render file, with what a
+// journal records as created or deleted since, so that Cleanup deletes what
+// exists even if the render file was not written after the last change, e.g.
+// because apply was killed. Namespaces r does not know yet are mapped to
+// themselves in Namespaces, as in ReadJournal.
+func (r *RenderedNetwork) ReplayJournal(rd io.Reader) error {
+	if r.Bridges == nil {
+		r.Bridges = make(map[string]struct{})
+	}
+	if r.BridgeTypes == nil {
+		r.BridgeTypes = make(map[string]string)
+	}
+	if r.Namespaces == nil {
+		r.Namespaces = make(map[string]string)
+	}
+	if r.Interfaces == nil {
+		r.Interfaces = make(map[string]struct{})
+	}
+	if r.Networks == nil {
+		r.Networks = make(map[string]string)
+	}
+	if r.PeerLinks == nil {
+		r.PeerLinks = make(map[string]map[string]*PeerLink)
+	}
+	pairs := make(map[string]string)
+
+	sc := bufio.NewScanner(rd)
+	var bad error
+	for line := 1; sc.Scan(); line++ {
+		if bad != nil {
+			return bad
+		}
+
+		var e journalEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			bad = errors.Wrapf(err, "journal line %d", line)
+			continue
+		}
+
+		switch e.Op {
+		case opBegin:
+			r.ID = e.ID
+		case opCreate:
+			r.resources = append(r.resources, resource{Kind: e.Kind, Name: e.Name, Peer: e.Peer, Type: e.Type})
+			switch e.Kind {
+			case resBridge:
+				r.Bridges[e.Name] = struct{}{}
+				r.BridgeTypes[e.Name] = e.Type
+			case resNamespace:
+				if !r.hasNamespace(e.Name) {
+					r.Namespaces[e.Name] = e.Name
+				}
+			case resVeth:
+				r.Interfaces[e.Name] = struct{}{}
+			case resVethPair:
+				r.Interfaces[e.Name] = struct{}{}
+				r.Interfaces[e.Peer] = struct{}{}
+				pairs[e.Name], pairs[e.Peer] = e.Peer, e.Name
+			}
+		case opMove:
+			delete(r.Interfaces, e.Name)
+		case opDelete:
+			switch e.Kind {
+			case resBridge:
+				delete(r.Bridges, e.Name)
+				delete(r.BridgeTypes, e.Name)
+				r.forgetBridge(e.Name)
+			case resNamespace:
+				r.forgetNamespace(e.Name)
+			case resVeth, resVethPair:
+				delete(r.Interfaces, e.Name)
+				delete(r.Interfaces, pairs[e.Name])
+			}
+		default:
+			return errors.Errorf("journal line %d: unknown operation %q", line, e.Op)
+		}
+	}
+	return sc.Err()
+}
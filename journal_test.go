@@ -0,0 +1,201 @@
+package netdef
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReadJournal(t *testing.T) {
+	cases := []struct {
+		name       string
+		journal    string
+		id         string
+		bridges    []string
+		namespaces []string
+		interfaces []string
+		err        string
+	}{
+		{
+			name: "created and deleted",
+			journal: `{"Op":"begin","ID":"abc"}
+{"Op":"create","Kind":"bridge","Name":"tbr0","Type":"linux"}
+{"Op":"create","Kind":"namespace","Name":"tns0"}
+{"Op":"create","Kind":"namespace","Name":"tns1"}
+{"Op":"create","Kind":"veth pair","Name":"tveth0","Peer":"ttap0"}
+{"Op":"move","Kind":"veth","Name":"tveth0","Namespace":"tns0"}
+{"Op":"create","Kind":"veth pair","Name":"tveth1","Peer":"ttap1"}
+{"Op":"delete","Kind":"veth","Name":"tveth1"}
+{"Op":"delete","Kind":"namespace","Name":"tns1"}
+`,
+			id:         "abc",
+			bridges:    []string{"tbr0"},
+			namespaces: []string{"tns0"},
+			interfaces: []string{"ttap0"},
+		},
+		{
+			name: "torn last line",
+			journal: `{"Op":"create","Kind":"bridge","Name":"tbr0","Type":"linux"}
+{"Op":"create","Kind":"name`,
+			bridges: []string{"tbr0"},
+		},
+		{
+			name: "bad line in the middle",
+			journal: `{"Op":"create","Kind":"bridge","Name":"tbr0","Type":"linux"}
+{"Op":"create","Kind":"name
+{"Op":"create","Kind":"bridge","Name":"tbr1","Type":"linux"}
+`,
+			err: "journal line 2",
+		},
+		{
+			name:    "unknown operation",
+			journal: `{"Op":"rename","Kind":"bridge","Name":"tbr0"}`,
+			err:     "unknown operation",
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, c := range cases {
+		r, err := ReadJournal(strings.NewReader(c.journal))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: got error %v, want one containing %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+
+		if r.ID != c.id {
+			t.Errorf("%s: got ID %q, want %q", c.name, r.ID, c.id)
+		}
+		var namespaces []string
+		for ns := range r.Namespaces {
+			namespaces = append(namespaces, ns)
+		}
+		sort.Strings(namespaces)
+		for _, cmp := range []struct {
+			what      string
+			got, want []string
+		}{
+			{"bridges", sortedKeys(r.Bridges), c.bridges},
+			{"namespaces", namespaces, c.namespaces},
+			{"interfaces", sortedKeys(r.Interfaces), c.interfaces},
+		} {
+			if len(cmp.got) == 0 && len(cmp.want) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(cmp.got, cmp.want) {
+				t.Errorf("%s: got %s %v, want %v", c.name, cmp.what, cmp.got, cmp.want)
+			}
+		}
+	}
+}
+
+func TestJournalRoundTrip(t *testing.T) {
+	cfg := testConfig()
+	cfg.Networks = []Network{{Name: "lan", IpRange: "10.0.0.0/24"}}
+	cfg.Peers = []Peer{
+		{Name: "a", Links: map[string]*LinkOpts{"lan": nil}},
+		{Name: "b", Links: map[string]*LinkOpts{"lan": nil}},
+	}
+
+	var journal bytes.Buffer
+	r := cfg.NewRenderedNetwork()
+	r.Runner = &fakeRunner{}
+	r.Journal = &journal
+	if err := cfg.Render(r); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadJournal(&journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != r.ID {
+		t.Errorf("got ID %q, want %q", got.ID, r.ID)
+	}
+	if !reflect.DeepEqual(got.Bridges, r.Bridges) {
+		t.Errorf("got bridges %v, want %v", got.Bridges, r.Bridges)
+	}
+	if !reflect.DeepEqual(got.Interfaces, r.Interfaces) {
+		t.Errorf("got interfaces %v, want %v", got.Interfaces, r.Interfaces)
+	}
+	if len(got.Namespaces) != len(r.Namespaces) {
+		t.Errorf("got namespaces %v, want those of %v", got.Namespaces, r.Namespaces)
+	}
+	for _, ns := range r.Namespaces {
+		if got.Namespaces[ns] != ns {
+			t.Errorf("namespace %s missing from journal", ns)
+		}
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	cfg := testConfig()
+	cfg.Networks = []Network{{Name: "lan", IpRange: "10.0.0.0/24"}}
+	cfg.Peers = []Peer{
+		{Name: "a", Links: map[string]*LinkOpts{"lan": nil}},
+		{Name: "b", Links: map[string]*LinkOpts{"lan": nil}},
+	}
+
+	var created bytes.Buffer
+	r := cfg.NewRenderedNetwork()
+	r.Runner = &fakeRunner{}
+	r.Journal = &created
+	if err := cfg.Render(r); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func() *RenderedNetwork {
+		var lr RenderedNetwork
+		if err := json.Unmarshal(saved, &lr); err != nil {
+			t.Fatal(err)
+		}
+		return &lr
+	}
+
+	// Replaying what the render file already records changes nothing.
+	got := load()
+	if err := got.ReplayJournal(&created); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Namespaces, r.Namespaces) || !reflect.DeepEqual(got.Interfaces, r.Interfaces) {
+		t.Errorf("got namespaces %v and interfaces %v, want %v and %v", got.Namespaces, got.Interfaces, r.Namespaces, r.Interfaces)
+	}
+
+	// An apply that was not written to the render file.
+	var applied bytes.Buffer
+	r.Journal = &applied
+	cfg.Peers = []Peer{
+		{Name: "a", Links: map[string]*LinkOpts{"lan": nil}},
+		{Name: "c", Links: map[string]*LinkOpts{"lan": nil}},
+	}
+	if _, err := r.Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	got = load()
+	if err := got.ReplayJournal(&applied); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": r.Namespaces["a"], r.Namespaces["c"]: r.Namespaces["c"]}
+	if !reflect.DeepEqual(got.Namespaces, want) {
+		t.Errorf("got namespaces %v, want %v", got.Namespaces, want)
+	}
+	if !reflect.DeepEqual(got.Interfaces, r.Interfaces) {
+		t.Errorf("got interfaces %v, want %v", got.Interfaces, r.Interfaces)
+	}
+	if got.ID != r.ID {
+		t.Errorf("got ID %q, want that of the render file %q", got.ID, r.ID)
+	}
+}
@@ -0,0 +1,318 @@
+package netdef
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// layout is a validated Config together with the addresses assigned to
+// everything it connects to a network.
+type layout struct {
+	cfg     *Config
+	nets    map[string]*Network
+	routers []routedLink
+	nats    []*natLink
+
+	// routerAddrs maps router names and then network names to addresses.
+	routerAddrs map[string]map[string][]string
+	// addrs maps peer names and then network names to addresses.
+	addrs map[string]map[string][]string
+}
+
+// validate checks a Config and parses everything in it, without assigning
+// any addresses.
+func (cfg *Config) validate() (*layout, error) {
+	if err := validBridgeType(cfg.Bridge); err != nil {
+		return nil, err
+	}
+	if err := validNaming(cfg.Naming); err != nil {
+		return nil, err
+	}
+	if err := validPrefixes(cfg.Prefixes, cfg.Naming); err != nil {
+		return nil, err
+	}
+
+	nets := make(map[string]*Network)
+	for i := range cfg.Networks {
+		n := cfg.Networks[i]
+		if _, ok := nets[n.Name]; ok {
+			return nil, fmt.Errorf("duplicate network name: %s", n.Name)
+		}
+
+		if err := validBridgeType(n.Bridge); err != nil {
+			return nil, errors.Wrapf(err, "network %s", n.Name)
+		}
+
+		n.pool = nil
+		if err := n.initPools(); err != nil {
+			return nil, err
+		}
+		nets[n.Name] = &n
+	}
+
+	peers := make(map[string]bool)
+	for _, p := range cfg.Peers {
+		_, ok := peers[p.Name]
+		if ok {
+			return nil, fmt.Errorf("duplicate peer name: %s", p.Name)
+		}
+		peers[p.Name] = true
+
+		for net, l := range p.Links {
+			if _, ok := nets[net]; !ok {
+				return nil, fmt.Errorf("peer %s has link to non-existent network %q", p.Name, net)
+			}
+
+			if l == nil {
+				continue
+			}
+			if err := l.Parse(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for name, net := range nets {
+		for targetNet, l := range net.Links {
+			if _, ok := nets[targetNet]; !ok {
+				return nil, fmt.Errorf("network %s has link to non-existent network %s", name, targetNet)
+			}
+
+			if l == nil {
+				continue
+			}
+			if err := l.Parse(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := cfg.validateSchedule(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateWorkloads(); err != nil {
+		return nil, err
+	}
+
+	routers, err := routedLinks(nets)
+	if err != nil {
+		return nil, err
+	}
+
+	nats, err := natLinks(nets)
+	if err != nil {
+		return nil, err
+	}
+
+	return &layout{
+		cfg:         cfg,
+		nets:        nets,
+		routers:     routers,
+		nats:        nats,
+		routerAddrs: make(map[string]map[string][]string),
+		addrs:       make(map[string]map[string][]string),
+	}, nil
+}
+
+// assignAddrs assigns addresses to every NAT, router and peer link that does
+// not have them yet. Static addresses are claimed first so they are never
+// handed out dynamically.
+func (p *layout) assignAddrs() error {
+	for _, peer := range p.cfg.Peers {
+		for _, net := range sortedKeys(peer.Links) {
+			l := peer.Links[net]
+			if l == nil || l.Address == "" || p.addrs[peer.Name][net] != nil {
+				continue
+			}
+			if err := p.nets[net].claim(l.Address, "peer "+peer.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	// NAT and other routers are assigned addresses before peers, so that
+	// they get the low addresses of each range.
+	for _, nl := range p.nats {
+		if nl.inside != nil {
+			continue
+		}
+
+		inside := p.nets[nl.network]
+		if inside.Gateway != "" {
+			nl.inside = []string{inside.pool.format(net.ParseIP(inside.Gateway), "", inside.BindMask)}
+		} else {
+			a, err := inside.assign("NAT of "+nl.network, "", "")
+			if err != nil {
+				return err
+			}
+			nl.inside = a[:1]
+		}
+
+		a, err := p.nets[nl.upstream].assign("NAT of "+nl.network, "", "")
+		if err != nil {
+			return err
+		}
+		nl.outside = a[:1]
+	}
+
+	for _, rl := range p.routers {
+		if p.routerAddrs[rl.name] != nil {
+			continue
+		}
+		p.routerAddrs[rl.name] = make(map[string][]string)
+		for _, n := range []string{rl.a, rl.b} {
+			a, err := p.nets[n].assign("router "+rl.name, "", "")
+			if err != nil {
+				return err
+			}
+			p.routerAddrs[rl.name][n] = a
+		}
+	}
+
+	for _, peer := range p.cfg.Peers {
+		if p.addrs[peer.Name] == nil {
+			p.addrs[peer.Name] = make(map[string][]string)
+		}
+		for _, net := range sortedKeys(peer.Links) {
+			l := peer.Links[net]
+			if p.addrs[peer.Name][net] != nil {
+				continue
+			}
+			var static string
+			if l != nil {
+				static = l.Address
+			}
+			a, err := p.nets[net].assign("peer "+peer.Name, static, peer.BindMask)
+			if err != nil {
+				return err
+			}
+			p.addrs[peer.Name][net] = a
+		}
+	}
+	return nil
+}
+
+// patchLink is a link between networks that is not routed.
+type patchLink struct {
+	a, b string
+	opts *LinkOpts
+}
+
+// patches returns the patched links of the layout, keyed "a:b".
+func (p *layout) patches() map[string]patchLink {
+	out := make(map[string]patchLink)
+	for name, n := range p.nets {
+		for target, l := range n.Links {
+			if l != nil && l.Routed {
+				continue
+			}
+			out[name+":"+target] = patchLink{name, target, l}
+		}
+	}
+	return out
+}
+
+// routes returns the routes every namespace of r needs for the layout, keyed
+// by namespace and then destination, with the gateway as value. Routers and
+// NATs must already have been created in r.
+func (p *layout) routes(r *RenderedNetwork) map[string]map[string]string {
+	table := make(map[string]map[string]string)
+	add := func(ns, dst, via string) {
+		if ns == "" || via == "" {
+			return
+		}
+		if table[ns] == nil {
+			table[ns] = make(map[string]string)
+		}
+		table[ns][dst] = via
+	}
+
+	if len(p.routers) > 0 {
+		type host struct {
+			ns       string
+			attached []string
+		}
+		var hosts []host
+		for _, peer := range p.cfg.Peers {
+			attached := make([]string, 0, len(peer.Links))
+			for net := range peer.Links {
+				attached = append(attached, net)
+			}
+			hosts = append(hosts, host{r.Namespaces[peer.Name], attached})
+		}
+		for _, rl := range p.routers {
+			hosts = append(hosts, host{r.Routers[rl.name], []string{rl.a, rl.b}})
+		}
+		for _, nl := range p.nats {
+			hosts = append(hosts, host{r.Nats[nl.network], []string{nl.network, nl.upstream}})
+		}
+
+		for _, h := range hosts {
+			for d, hop := range nextHops(h.attached, p.routers) {
+				for _, pool := range []*addrPool{p.nets[d].pool, p.nets[d].pool6} {
+					if pool == nil {
+						continue
+					}
+					dst := pool.ipnet.String()
+					add(h.ns, dst, sameFamily(dst, r.RouterLinks[hop.router][hop.network].addrs()))
+				}
+			}
+		}
+	}
+
+	for _, nl := range p.nats {
+		gw := sameFamily("0.0.0.0/0", r.NatLinks[nl.network][nl.network].addrs())
+		for _, peer := range p.cfg.Peers {
+			if _, ok := peer.Links[nl.network]; ok {
+				add(r.Namespaces[peer.Name], "0.0.0.0/0", gw)
+			}
+		}
+		// NATs behind this one reach the outside through it too.
+		for _, inner := range p.nats {
+			if inner.upstream == nl.network {
+				add(r.Nats[inner.network], "0.0.0.0/0", gw)
+			}
+		}
+	}
+
+	return table
+}
+
+// bridgeType returns the type of bridge the layout uses for a network.
+func (p *layout) bridgeType(network string) string {
+	typ := p.nets[network].Bridge
+	if typ == "" {
+		typ = p.cfg.Bridge
+	}
+	if typ == "" {
+		typ = BridgeOVS
+	}
+	return typ
+}
+
+// addRoutes installs every route in table, in a stable order.
+func (r *RenderedNetwork) addRoutes(table map[string]map[string]string) error {
+	for _, ns := range sortedKeys(table) {
+		for _, dst := range sortedKeys(table[ns]) {
+			if err := r.backend().AddRoute(ns, dst, table[ns][dst]); err != nil {
+				return errors.Wrapf(err, "adding route to %s in %s", dst, ns)
+			}
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a map with string keys in order.
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	out := make([]string, len(keys))
+	for i, k := range keys {
+		out[i] = k.String()
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,43 @@
+package netdef
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// LockPath is the lock file that netdef processes on a host hold while they
+// pick names and create things with them. Names are picked by looking at what
+// exists, so without it two processes could pick the same name.
+var LockPath = "/run/netdef/lock"
+
+// lockHost takes the host-wide lock for r. Nothing is locked when r's commands
+// are only printed or faked, since nothing is created then.
+func (r *RenderedNetwork) lockHost() (func(), error) {
+	if !r.changesHost() {
+		return func() {}, nil
+	}
+	return LockHost()
+}
+
+// LockHost takes the host-wide lock at LockPath, waiting for other processes
+// to release it, and returns a function that releases it.
+func LockHost() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(LockPath), 0755); err != nil {
+		return nil, errors.Wrap(err, "creating lock directory")
+	}
+	f, err := os.OpenFile(LockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening lock file")
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "locking")
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,222 @@
+package netdef
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+// Naming schemes understood by Config.Naming.
+const (
+	// NamingSequential names things with their prefix followed by the
+	// lowest number not in use on the host. It is the default.
+	NamingSequential = "sequential"
+	// NamingHashed names things with their prefix followed by a hash of
+	// the instance name and of what they are for, so that they get the same
+	// names every time a config is rendered.
+	NamingHashed = "hashed"
+)
+
+// maxIfNameLen is the longest interface name Linux accepts.
+const maxIfNameLen = 15
+
+// maxPrefixLen is the longest prefix allowed for interface names, leaving
+// room for at least four digits.
+const maxPrefixLen = maxIfNameLen - 4
+
+// minHashLen is the fewest hash characters in a hashed name. Fewer would make
+// names for different things likely to collide.
+const minHashLen = 8
+
+// maxHashedPrefixLen is the longest prefix allowed for interface names with
+// hashed naming.
+const maxHashedPrefixLen = maxIfNameLen - minHashLen
+
+// ifacePrefixes are the keys of Config.Prefixes used for interface names. The
+// other keys are used for namespace names, which are not limited in length.
+var ifacePrefixes = map[string]bool{
+	"Bridge":    true,
+	"Interface": true,
+	"Patch":     true,
+	"Port":      true,
+	"Namespace": false,
+	"Router":    false,
+	"Nat":       false,
+}
+
+func validNaming(n string) error {
+	switch n {
+	case "", NamingSequential, NamingHashed:
+		return nil
+	}
+	return fmt.Errorf("unknown naming scheme: %q", n)
+}
+
+// validPrefixes checks that every prefix is known and can start a legal name
+// with the naming scheme.
+func validPrefixes(prefixes map[string]string, naming string) error {
+	max := maxPrefixLen
+	if naming == NamingHashed {
+		max = maxHashedPrefixLen
+	}
+	for _, k := range sortedKeys(prefixes) {
+		p := prefixes[k]
+		iface, ok := ifacePrefixes[k]
+		switch {
+		case !ok:
+			return fmt.Errorf("unknown prefix: %s", k)
+		case p == "":
+			return fmt.Errorf("prefix %s is empty", k)
+		case strings.ContainsAny(p, "/ \t\n") || iface && strings.ContainsRune(p, ':'):
+			return fmt.Errorf("prefix %s %q contains characters not allowed in names", k, p)
+		case iface && len(p) > max:
+			return fmt.Errorf("prefix %s %q is longer than %d bytes", k, p, max)
+		}
+	}
+	return nil
+}
+
+// hashedName derives a name from prefix and a hash of key that is as long as
+// an interface name may be, or has minHashLen hash characters if prefix is too
+// long for that.
+func hashedName(prefix, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	n := maxIfNameLen - len(prefix)
+	if n < minHashLen {
+		n = minHashLen
+	}
+	return prefix + hex.EncodeToString(sum[:])[:n]
+}
+
+// checkNaming checks that r can be named as cfg says. Hashed names are derived
+// from r.Name, so without one every network would get the same names.
+func (r *RenderedNetwork) checkNaming(cfg *Config) error {
+	if cfg.Naming == NamingHashed && r.Name == "" {
+		return fmt.Errorf("hashed naming needs a network name, e.g. an instance name")
+	}
+	return nil
+}
+
+// pickName picks a name with the prefix for typ for the thing described by
+// logical, and records the mapping in Names. host lists the names in use on
+// the host.
+func (r *RenderedNetwork) pickName(typ, logical string, host func() ([]string, error)) (string, error) {
+	prefix := r.prefixes[typ]
+
+	var name string
+	if r.naming == NamingHashed {
+		name = hashedName(prefix, r.Name+"/"+logical)
+		if r.uses(name) {
+			return "", fmt.Errorf("name %s for %s is already used by this network", name, logical)
+		}
+		// The host only reflects r when commands are really run.
+		if r.changesHost() {
+			names, err := host()
+			if err != nil {
+				return "", err
+			}
+			for _, n := range names {
+				if n == name {
+					return "", fmt.Errorf("name %s for %s already exists; is another instance of this config running under the same name?", name, logical)
+				}
+			}
+		}
+	} else {
+		names, err := host()
+		if err != nil {
+			return "", err
+		}
+		name = freshName(prefix, append(names, r.takenNames()...))
+	}
+
+	if ifacePrefixes[typ] && len(name) > maxIfNameLen {
+		return "", fmt.Errorf("name %s for %s is longer than %d bytes", name, logical, maxIfNameLen)
+	}
+
+	r.take(name)
+	if r.Names == nil {
+		r.Names = make(map[string]string)
+	}
+	r.Names[name] = logical
+	return name, nil
+}
+
+// uses reports whether r tracks a bridge, namespace or interface named name.
+func (r *RenderedNetwork) uses(name string) bool {
+	if _, ok := r.Bridges[name]; ok {
+		return true
+	}
+	if _, ok := r.Interfaces[name]; ok {
+		return true
+	}
+	if r.hasNamespace(name) {
+		return true
+	}
+	for _, m := range []map[string]map[string]*PeerLink{r.PeerLinks, r.RouterLinks, r.NatLinks} {
+		for _, links := range m {
+			for _, pl := range links {
+				if pl.Interface == name || pl.Port == name {
+					return true
+				}
+			}
+		}
+	}
+	for _, pt := range r.Patches {
+		for _, port := range pt.Ports {
+			if port == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// interfaceNames returns the names listed by list along with the interfaces
+// openvswitch knows of.
+func (r *RenderedNetwork) interfaceNames(list func() ([]string, error)) ([]string, error) {
+	names, err := list()
+	if err != nil {
+		return nil, err
+	}
+	ovs, err := r.ovsInterfaceNames()
+	if err != nil {
+		return nil, err
+	}
+	return append(names, ovs...), nil
+}
+
+// hostInterfaceNames lists the interfaces in the global namespace.
+func hostInterfaceNames() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(ifaces))
+	for i, iface := range ifaces {
+		names[i] = iface.Name
+	}
+	return names, nil
+}
+
+// namespaceNames lists the named namespaces.
+func namespaceNames() ([]string, error) {
+	files, err := ioutil.ReadDir("/var/run/netns")
+	if os.IsNotExist(err) {
+		// Directory doesn't exist, assume there are no namespaces
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
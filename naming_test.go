@@ -0,0 +1,138 @@
+package netdef
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidPrefixes(t *testing.T) {
+	cases := []struct {
+		prefixes map[string]string
+		naming   string
+		err      string
+	}{
+		{prefixes: map[string]string{"Bridge": "br", "Namespace": "a-very-long-namespace-prefix"}},
+		{prefixes: map[string]string{"Bridge": "abcdefghijk"}},
+		{prefixes: map[string]string{"Bridge": "abcdefghijkl"}, err: "longer than 11 bytes"},
+		{prefixes: map[string]string{"Bridge": "abcdefg"}, naming: NamingHashed},
+		{prefixes: map[string]string{"Bridge": "abcdefgh"}, naming: NamingHashed, err: "longer than 7 bytes"},
+		{prefixes: map[string]string{"Namespace": "a-very-long-namespace-prefix"}, naming: NamingHashed},
+		{prefixes: map[string]string{"Port": ""}, err: "is empty"},
+		{prefixes: map[string]string{"Port": "a/b"}, err: "not allowed"},
+		{prefixes: map[string]string{"Port": "a:b"}, err: "not allowed"},
+		{prefixes: map[string]string{"Namespace": "a:b"}},
+		{prefixes: map[string]string{"Switch": "sw"}, err: "unknown prefix"},
+	}
+	for _, c := range cases {
+		err := validPrefixes(c.prefixes, c.naming)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%v: %s", c.prefixes, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%v: got error %v, want one containing %q", c.prefixes, err, c.err)
+		}
+	}
+}
+
+func TestHashedName(t *testing.T) {
+	cases := []struct {
+		prefix string
+		len    int
+	}{
+		{"br", maxIfNameLen},
+		{"abcdefg", maxIfNameLen},
+		{"abcdefghijk", len("abcdefghijk") + minHashLen},
+		{"a-very-long-namespace-prefix", len("a-very-long-namespace-prefix") + minHashLen},
+	}
+	for _, c := range cases {
+		a := hashedName(c.prefix, "demo/peer wolf")
+		if len(a) != c.len || !strings.HasPrefix(a, c.prefix) {
+			t.Errorf("hashedName(%q): got %q, want %d bytes with the prefix", c.prefix, a, c.len)
+		}
+		if b := hashedName(c.prefix, "demo/peer wolf"); a != b {
+			t.Errorf("hashedName(%q) is not stable: %q then %q", c.prefix, a, b)
+		}
+		if b := hashedName(c.prefix, "other/peer wolf"); a == b {
+			t.Errorf("hashedName(%q) is the same for different keys: %q", c.prefix, a)
+		}
+	}
+}
+
+func TestFreshName(t *testing.T) {
+	cases := []struct {
+		existing []string
+		want     string
+	}{
+		{nil, "br0"},
+		{[]string{"eth0", "veth3"}, "br0"},
+		{[]string{"br0", "br2", "brx"}, "br3"},
+		{[]string{"brx"}, "br1"},
+	}
+	for _, c := range cases {
+		if got := freshName("br", c.existing); got != c.want {
+			t.Errorf("freshName(%v): got %s, want %s", c.existing, got, c.want)
+		}
+	}
+}
+
+func TestNaming(t *testing.T) {
+	cfg := testConfig()
+	cfg.Networks = []Network{
+		{Name: "lan", IpRange: "10.0.0.0/24", Links: map[string]*LinkOpts{"wan": {Routed: true}}},
+		{Name: "wan", IpRange: "10.1.0.0/24"},
+	}
+	cfg.Peers = []Peer{
+		{Name: "a", Links: map[string]*LinkOpts{"lan": nil}},
+		{Name: "b", Links: map[string]*LinkOpts{"lan": nil, "wan": nil}},
+	}
+
+	render := func(naming, name string) *RenderedNetwork {
+		cfg.Naming = naming
+		f := &fakeRunner{}
+		r := cfg.NewRenderedNetwork()
+		r.Name = name
+		r.Runner = f
+		if err := cfg.Render(r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	seq := render(NamingSequential, "demo")
+	if got := seq.Namespaces["a"]; got != "tns0" {
+		t.Errorf("sequential: peer a got namespace %s, want tns0", got)
+	}
+	if got := seq.Networks["wan"]; got != "tbr1" {
+		t.Errorf("sequential: network wan got bridge %s, want tbr1", got)
+	}
+
+	a, b := render(NamingHashed, "demo"), render(NamingHashed, "demo")
+	if !reflect.DeepEqual(a.Names, b.Names) {
+		t.Errorf("hashed names differ between renders:\n%v\n%v", a.Names, b.Names)
+	}
+	if want := hashedName("tns", "demo/peer a"); a.Namespaces["a"] != want {
+		t.Errorf("hashed: peer a got namespace %s, want %s", a.Namespaces["a"], want)
+	}
+	if other := render(NamingHashed, "other"); other.Namespaces["a"] == a.Namespaces["a"] {
+		t.Errorf("hashed: instances demo and other share namespace %s", a.Namespaces["a"])
+	}
+
+	cfg.Naming = NamingHashed
+	unnamed := cfg.NewRenderedNetwork()
+	unnamed.Runner = &fakeRunner{}
+	if err := cfg.Render(unnamed); err == nil || !strings.Contains(err.Error(), "needs a network name") {
+		t.Errorf("hashed without a name: got error %v", err)
+	}
+
+	for _, r := range []*RenderedNetwork{seq, a} {
+		for name, what := range r.Names {
+			if what == "" {
+				t.Errorf("%s: no record of what it is for", name)
+			}
+			if !strings.HasPrefix(name, "tns") && !strings.HasPrefix(name, "trt") && len(name) > maxIfNameLen {
+				t.Errorf("interface name %s is longer than %d bytes", name, maxIfNameLen)
+			}
+		}
+	}
+}
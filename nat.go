@@ -0,0 +1,241 @@
+package netdef
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NAT behaviors for NatOpts.Type. The cone types map every internal address
+// and port to the same external port regardless of destination, and differ in
+// which inbound packets they let through to a mapping.
+const (
+	// NatFullCone accepts inbound packets from anyone to a mapped port.
+	NatFullCone = "full-cone"
+	// NatAddressRestricted accepts inbound packets to a mapped port only
+	// from addresses the internal host has sent to.
+	NatAddressRestricted = "address-restricted"
+	// NatPortRestricted accepts inbound packets to a mapped port only from
+	// addresses and ports the internal host has sent to. It is the default.
+	NatPortRestricted = "port-restricted"
+	// NatSymmetric picks a new external port for every destination and only
+	// accepts replies.
+	NatSymmetric = "symmetric"
+)
+
+// NatOpts puts a network behind a NAT router, which is connected to an
+// upstream network and translates traffic leaving the network to its own
+// upstream address. The NAT is built with nftables, which must be installed.
+// Only IPv4 traffic is translated.
+type NatOpts struct {
+	// Upstream is the network on the outside of the NAT.
+	Upstream string
+	// Type is the NAT behavior, one of "full-cone", "address-restricted",
+	// "port-restricted" (the default) or "symmetric".
+	Type string
+	// Hairpin lets peers behind the NAT reach each other through mappings
+	// on its upstream address. It is only supported by the cone types.
+	Hairpin bool
+	// Link describes the physical qualities of the NAT's upstream link.
+	Link *LinkOpts
+}
+
+// natLink is a NAT router planned by Config.Render.
+type natLink struct {
+	network  string
+	upstream string
+	opts     *NatOpts
+	inside   []string
+	outside  []string
+}
+
+// validate checks the NatOpts of the network name against the other networks.
+func (no *NatOpts) validate(name string, nets map[string]*Network) error {
+	up, ok := nets[no.Upstream]
+	if !ok {
+		return fmt.Errorf("network %s has NAT to non-existent network %q", name, no.Upstream)
+	}
+	if no.Upstream == name {
+		return fmt.Errorf("network %s has NAT to itself", name)
+	}
+
+	switch no.Type {
+	case "", NatFullCone, NatAddressRestricted, NatPortRestricted:
+	case NatSymmetric:
+		if no.Hairpin {
+			return fmt.Errorf("network %s: hairpinning requires a cone NAT type", name)
+		}
+	default:
+		return fmt.Errorf("network %s: unknown NAT type %q", name, no.Type)
+	}
+
+	if nets[name].pool.ipnet.IP.To4() == nil || up.pool.ipnet.IP.To4() == nil {
+		return fmt.Errorf("network %s: NAT requires IPv4 ranges on both sides", name)
+	}
+
+	if no.Link != nil {
+		if err := no.Link.Parse(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// natLinks returns the NAT routers of nets, ordered by network name.
+func natLinks(nets map[string]*Network) ([]*natLink, error) {
+	var out []*natLink
+	for name, n := range nets {
+		if n.Nat == nil {
+			continue
+		}
+		if err := n.Nat.validate(name, nets); err != nil {
+			return nil, err
+		}
+		out = append(out, &natLink{
+			network:  name,
+			upstream: n.Nat.Upstream,
+			opts:     n.Nat,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].network < out[j].network })
+	return out, nil
+}
+
+// CreateNat creates a namespace for the NAT router of a network and, once it
+// exists, logs a mapping of the network name to the generated namespace name.
+// Forwarding is enabled within the namespace.
+func (r *RenderedNetwork) CreateNat(network string) error {
+	err := r.createNamespace("Nat", "nat "+network, func(ns string) {
+		if r.Nats == nil {
+			r.Nats = make(map[string]string)
+		}
+		r.Nats[network] = ns
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.enableForwarding(r.Nats[network])
+}
+
+// recordNatLink stores the record of a NAT router's link to a network.
+func (r *RenderedNetwork) recordNatLink(nat, network string, pl *PeerLink) {
+	if r.NatLinks == nil {
+		r.NatLinks = make(map[string]map[string]*PeerLink)
+	}
+	if r.NatLinks[nat] == nil {
+		r.NatLinks[nat] = make(map[string]*PeerLink)
+	}
+	r.NatLinks[nat][network] = pl
+}
+
+// createNats creates and configures the NAT router of each natLink.
+func (r *RenderedNetwork) createNats(links []*natLink) error {
+	for _, nl := range links {
+		if err := r.CreateNat(nl.network); err != nil {
+			return errors.Wrapf(err, "creating NAT for %s", nl.network)
+		}
+		ns := r.Nats[nl.network]
+
+		in, err := r.attach("nat "+nl.network+" on "+nl.network, ns, r.Networks[nl.network], nl.inside, nil)
+		if err != nil {
+			return errors.Wrapf(err, "connecting NAT for %s", nl.network)
+		}
+		r.recordNatLink(nl.network, nl.network, in)
+
+		out, err := r.attach("nat "+nl.network+" on "+nl.upstream, ns, r.Networks[nl.upstream], nl.outside, nl.opts.Link)
+		if err != nil {
+			return errors.Wrapf(err, "connecting NAT for %s", nl.network)
+		}
+		r.recordNatLink(nl.network, nl.upstream, out)
+
+		ext := sameFamily("0.0.0.0/0", nl.outside)
+		_, inside, err := net.ParseCIDR(nl.inside[0])
+		if err != nil {
+			return err
+		}
+		for _, rule := range natRules(nl.opts.Type, in.Interface, out.Interface, ext, inside.String(), nl.opts.Hairpin) {
+			if err := r.NetNsExec(ns, "nft", rule...); err != nil {
+				return errors.Wrapf(err, "configuring NAT for %s", nl.network)
+			}
+		}
+	}
+	return nil
+}
+
+// natRules returns the nft commands that configure a NAT router with the
+// interface in on the inside network and out, with address ext, on the
+// upstream network.
+//
+// Mappings are made with masquerade, which keeps the internal source port
+// when it is free and picks another one when it is not. The cone types record
+// the internal address and port behind each external port once packets have
+// been translated, and use that record to forward inbound packets that have no
+// conntrack entry yet.
+func natRules(typ, in, out, ext, inside string, hairpin bool) [][]string {
+	if typ == "" {
+		typ = NatPortRestricted
+	}
+	cone := typ != NatSymmetric
+
+	cmds := []string{
+		"add table ip netdef",
+		"add chain ip netdef prerouting { type nat hook prerouting priority dstnat ; }",
+		"add chain ip netdef postrouting { type nat hook postrouting priority srcnat ; }",
+		"add chain ip netdef forward { type filter hook forward priority filter ; policy accept ; }",
+	}
+	if cone {
+		cmds = append(cmds,
+			"add chain ip netdef mapping { type filter hook postrouting priority srcnat + 10 ; policy accept ; }",
+			"add map ip netdef mappings { type inet_service : ipv4_addr . inet_service ; flags dynamic,timeout ; timeout 2m ; }",
+		)
+	}
+	if typ == NatAddressRestricted {
+		cmds = append(cmds, "add set ip netdef contacted { type ipv4_addr . inet_service ; flags dynamic,timeout ; timeout 2m ; }")
+	}
+
+	if cone {
+		cmds = append(cmds, fmt.Sprintf("add rule ip netdef postrouting oifname %s masquerade", out))
+	} else {
+		cmds = append(cmds, fmt.Sprintf("add rule ip netdef postrouting oifname %s masquerade random", out))
+	}
+
+	// Mappings are refreshed by every outbound packet. The mapping chain
+	// runs after masquerade, so th sport is the external port there and
+	// the original tuple of the connection holds the internal one.
+	if cone {
+		cmds = append(cmds, fmt.Sprintf("add rule ip netdef mapping oifname %s meta l4proto { tcp, udp } update @mappings { th sport : ct original ip saddr . ct original proto-src }", out))
+	}
+	if typ == NatAddressRestricted {
+		cmds = append(cmds, fmt.Sprintf("add rule ip netdef mapping oifname %s meta l4proto { tcp, udp } update @contacted { ip daddr . th sport }", out))
+	}
+	cmds = append(cmds, "add rule ip netdef forward ct state established,related accept")
+	cmds = append(cmds, fmt.Sprintf("add rule ip netdef forward iifname %s accept", in))
+	if cone {
+		cmds = append(cmds, "add rule ip netdef forward ct status dnat accept")
+	}
+	cmds = append(cmds, fmt.Sprintf("add rule ip netdef forward iifname %s drop", out))
+
+	switch typ {
+	case NatFullCone:
+		cmds = append(cmds, fmt.Sprintf("add rule ip netdef prerouting iifname %s ip daddr %s meta l4proto { tcp, udp } dnat ip addr . port to th dport map @mappings", out, ext))
+	case NatAddressRestricted:
+		cmds = append(cmds, fmt.Sprintf("add rule ip netdef prerouting iifname %s ip daddr %s meta l4proto { tcp, udp } ip saddr . th dport @contacted dnat ip addr . port to th dport map @mappings", out, ext))
+	}
+
+	if hairpin {
+		cmds = append(cmds,
+			fmt.Sprintf("add rule ip netdef prerouting iifname %s ip daddr %s meta l4proto { tcp, udp } dnat ip addr . port to th dport map @mappings", in, ext),
+			fmt.Sprintf("add rule ip netdef postrouting oifname %s ip saddr %s snat to %s", in, inside, ext),
+		)
+	}
+
+	rules := make([][]string, len(cmds))
+	for i, c := range cmds {
+		rules[i] = strings.Fields(c)
+	}
+	return rules
+}
@@ -0,0 +1,102 @@
+package netdef
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNatRules(t *testing.T) {
+	const (
+		mapRule   = "add rule ip netdef mapping oifname out meta l4proto { tcp, udp } update @mappings { th sport : ct original ip saddr . ct original proto-src }"
+		inbound   = "add rule ip netdef prerouting iifname out ip daddr 10.0.0.2 meta l4proto { tcp, udp }"
+		contacted = "add rule ip netdef mapping oifname out meta l4proto { tcp, udp } update @contacted { ip daddr . th sport }"
+		hairpin   = "add rule ip netdef prerouting iifname in ip daddr 10.0.0.2"
+	)
+
+	cases := []struct {
+		typ     string
+		hairpin bool
+		want    []string
+		notWant []string
+	}{
+		{
+			typ:     NatSymmetric,
+			want:    []string{"masquerade random"},
+			notWant: []string{"@mappings", "@contacted", inbound},
+		},
+		{
+			typ:     NatFullCone,
+			want:    []string{mapRule, inbound + " dnat ip addr . port to th dport map @mappings"},
+			notWant: []string{"masquerade random", "@contacted"},
+		},
+		{
+			typ:  NatAddressRestricted,
+			want: []string{mapRule, contacted, inbound + " ip saddr . th dport @contacted dnat ip addr . port to th dport map @mappings"},
+		},
+		{
+			// Port-restricted is the default.
+			typ:     "",
+			want:    []string{mapRule},
+			notWant: []string{inbound, "@contacted"},
+		},
+		{
+			typ:     NatPortRestricted,
+			hairpin: true,
+			want: []string{
+				hairpin + " meta l4proto { tcp, udp } dnat ip addr . port to th dport map @mappings",
+				"add rule ip netdef postrouting oifname in ip saddr 192.168.0.0/24 snat to 10.0.0.2",
+			},
+		},
+	}
+	for _, c := range cases {
+		var got []string
+		for _, rule := range natRules(c.typ, "in", "out", "10.0.0.2", "192.168.0.0/24", c.hairpin) {
+			got = append(got, strings.Join(rule, " "))
+		}
+		all := strings.Join(got, "\n")
+
+		for _, w := range c.want {
+			if !strings.Contains(all, w) {
+				t.Errorf("%q: missing %q in\n%s", c.typ, w, all)
+			}
+		}
+		for _, w := range c.notWant {
+			if strings.Contains(all, w) {
+				t.Errorf("%q: unexpected %q in\n%s", c.typ, w, all)
+			}
+		}
+		if !c.hairpin && strings.Contains(all, hairpin) {
+			t.Errorf("%q: hairpin rules without hairpinning", c.typ)
+		}
+		// Mappings must be keyed by the port after translation, which only
+		// the mapping chain sees.
+		for _, rule := range got {
+			if strings.Contains(rule, "update @") && !strings.HasPrefix(rule, "add rule ip netdef mapping ") {
+				t.Errorf("%q: mapping recorded before translation: %s", c.typ, rule)
+			}
+		}
+	}
+}
+
+func TestNestedNatRoutes(t *testing.T) {
+	cfg := testConfig()
+	cfg.Networks = []Network{
+		{Name: "internet", IpRange: "10.0.0.0/24"},
+		{Name: "isp", IpRange: "10.1.0.0/24", Gateway: "10.1.0.254", Nat: &NatOpts{Upstream: "internet"}},
+		{Name: "home", IpRange: "10.2.0.0/24", Nat: &NatOpts{Upstream: "isp", Type: NatFullCone}},
+	}
+	cfg.Peers = []Peer{
+		{Name: "a", Links: map[string]*LinkOpts{"home": nil}},
+		{Name: "s", Links: map[string]*LinkOpts{"internet": nil}},
+	}
+	r, f := renderFake(t, cfg)
+
+	want := []string{
+		"ip netns exec " + r.Nats["home"] + " ip route add 0.0.0.0/0 via 10.1.0.254",
+		"ip netns exec " + r.Namespaces["a"] + " ip route add 0.0.0.0/0 via 10.2.0.1",
+	}
+	got := f.grep("route add 0.0.0.0/0")
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got default routes\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -4,6 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/urfave/cli"
 	"github.com/whyrusleeping/go-netdef"
@@ -36,18 +44,355 @@ func writeRender(path string, r *netdef.RenderedNetwork) error {
 	return nil
 }
 
+func readRender(path string) (*netdef.RenderedNetwork, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	r := &netdef.RenderedNetwork{}
+	if err := json.NewDecoder(fi).Decode(r); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// renderPath resolves the render argument of a command, which is either the
+// path of a render file or the name of an instance. instance reports which.
+func renderPath(arg string) (path string, instance bool) {
+	if _, err := os.Stat(arg); err == nil || strings.ContainsRune(arg, os.PathSeparator) {
+		return arg, false
+	}
+	dir, err := netdef.InstanceDir(arg)
+	if err != nil {
+		return arg, false
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return arg, false
+	}
+	path, _ = netdef.InstanceRender(arg)
+	return path, true
+}
+
+// newInstance registers the named instance and returns the path of its render
+// file. Nothing is registered on a dry run.
+func newInstance(c *cli.Context, name string) (string, error) {
+	path, err := netdef.InstanceRender(name)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(path)
+	if c.Bool("dry-run") {
+		if _, err := os.Stat(dir); err == nil {
+			return "", fmt.Errorf("instance %s already exists", name)
+		}
+		return path, nil
+	}
+
+	if err := os.MkdirAll(netdef.StateDir, 0755); err != nil {
+		return "", err
+	}
+	// Creating the directory claims the name, even against another netdef
+	// creating the same instance at the same time.
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if os.IsExist(err) {
+			return "", fmt.Errorf("instance %s already exists", name)
+		}
+		return "", err
+	}
+	return path, nil
+}
+
+// removeInstance unregisters the instance whose render file is at path.
+func removeInstance(path string) {
+	if err := os.RemoveAll(filepath.Dir(path)); err != nil {
+		fmt.Fprintln(os.Stderr, "removing instance:", err)
+	}
+}
+
+// runnerFlags select how a command makes changes to the host.
+var runnerFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "Print the commands that would be run instead of running them",
+	},
+	cli.StringFlag{
+		Name:  "record",
+		Usage: "Path to write a replayable transcript of the commands run",
+	},
+	cli.BoolFlag{
+		Name:  "netlink",
+		Usage: "Manage namespaces and veths over netlink instead of with the ip binary",
+	},
+}
+
+// setupRunner configures r according to runnerFlags. The returned function
+// must be called once r is no longer used.
+func setupRunner(c *cli.Context, r *netdef.RenderedNetwork) (func(), error) {
+	if c.Bool("netlink") {
+		if c.Bool("dry-run") || c.String("record") != "" {
+			return nil, fmt.Errorf("--netlink cannot be combined with --dry-run or --record")
+		}
+		r.Backend = netdef.NetlinkBackend{}
+	}
+
+	if c.Bool("dry-run") {
+		r.Runner = &netdef.DryRunner{Out: os.Stdout}
+	} else if c.String("record") != "" {
+		rec, err := os.Create(c.String("record"))
+		if err != nil {
+			return nil, err
+		}
+		r.Runner = &netdef.Recorder{Out: rec}
+		return func() { rec.Close() }, nil
+	}
+
+	return func() {}, nil
+}
+
+// journalPath returns the path of the journal kept next to a render file.
+func journalPath(render string) string {
+	return render + ".journal"
+}
+
+// openJournal makes r journal the resources it creates and deletes next to
+// the render file at render. A fresh journal replaces any existing one.
+// Nothing is journaled on a dry run. The returned function must be called
+// once r is no longer used.
+func openJournal(c *cli.Context, r *netdef.RenderedNetwork, render string, fresh bool) (func(), error) {
+	if c.Bool("dry-run") {
+		return func() {}, nil
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if fresh {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(journalPath(render), flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r.Journal = f
+	return func() { f.Close() }, nil
+}
+
+// registerRender registers the render file of r at render, so that gc leaves
+// r alone while the render file or its journal exists. Nothing is registered
+// on a dry run.
+func registerRender(c *cli.Context, r *netdef.RenderedNetwork, render string) error {
+	if c.Bool("dry-run") {
+		return nil
+	}
+	return netdef.RegisterRender(r.ID, render)
+}
+
+// resourceList lists host resources by kind.
+type resourceList struct {
+	bridges, namespaces, interfaces []string
+}
+
+// trackedResources returns the bridges, namespaces and interfaces r tracks.
+func trackedResources(r *netdef.RenderedNetwork) resourceList {
+	var l resourceList
+	for br := range r.Bridges {
+		l.bridges = append(l.bridges, br)
+	}
+	for _, m := range []map[string]string{r.Namespaces, r.Routers, r.Nats} {
+		for _, ns := range m {
+			l.namespaces = append(l.namespaces, ns)
+		}
+	}
+	for iface := range r.Interfaces {
+		l.interfaces = append(l.interfaces, iface)
+	}
+	sort.Strings(l.bridges)
+	sort.Strings(l.namespaces)
+	sort.Strings(l.interfaces)
+	return l
+}
+
+// minus returns the resources in l that are not in o.
+func (l resourceList) minus(o resourceList) resourceList {
+	sub := func(a, b []string) []string {
+		var out []string
+		for _, x := range a {
+			found := false
+			for _, y := range b {
+				found = found || x == y
+			}
+			if !found {
+				out = append(out, x)
+			}
+		}
+		return out
+	}
+	return resourceList{
+		bridges:    sub(l.bridges, o.bridges),
+		namespaces: sub(l.namespaces, o.namespaces),
+		interfaces: sub(l.interfaces, o.interfaces),
+	}
+}
+
+// String describes the resources in l, or returns "" if there are none.
+func (l resourceList) String() string {
+	var parts []string
+	for _, kind := range []struct {
+		name  string
+		names []string
+	}{
+		{"bridges", l.bridges},
+		{"namespaces", l.namespaces},
+		{"interfaces", l.interfaces},
+	} {
+		if len(kind.names) > 0 {
+			parts = append(parts, kind.name+": "+strings.Join(kind.names, " "))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// reportLeftovers tells the user what a failed command left on the host and,
+// if anything, writes a render file to path so that it can be cleaned up with
+// `netdef cleanup <ref>`. It reports whether anything was left.
+func reportLeftovers(r *netdef.RenderedNetwork, path, ref string) bool {
+	left := trackedResources(r).String()
+	if left == "" {
+		fmt.Fprintln(os.Stderr, "nothing was left behind")
+		return false
+	}
+
+	fmt.Fprintln(os.Stderr, "left behind", left)
+	if err := writeRender(path, r); err != nil {
+		fmt.Fprintln(os.Stderr, "writing render file:", err)
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "run `netdef cleanup %s` to remove it\n", ref)
+	return true
+}
+
+// runInPeer runs cmd with the standard streams of netdef and returns an error
+// that makes netdef exit with the status of cmd.
+func runInPeer(cmd *exec.Cmd) error {
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	// Interrupts from the terminal go to cmd as well; netdef waits for it
+	// to exit instead of dying first.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGQUIT)
+	defer signal.Stop(sigs)
+
+	err := cmd.Run()
+	if ee, ok := err.(*exec.ExitError); ok {
+		code := ee.ExitCode()
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			code = 128 + int(ws.Signal())
+		}
+		return cli.NewExitError("", code)
+	}
+	return err
+}
+
+// hasWorkloads reports whether any peer of cfg has workloads.
+func hasWorkloads(cfg *netdef.Config) bool {
+	for _, p := range cfg.Peers {
+		if len(p.Workloads) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// describeResult summarizes the outcome of a workload in one line.
+func describeResult(res *netdef.WorkloadResult) string {
+	s := fmt.Sprintf("%s/%s:", res.Peer, res.Name)
+	switch {
+	case res.Error != "":
+		return s + " " + res.Error
+	case len(res.ExitCodes) == 0:
+		return s + " not started"
+	}
+	s += fmt.Sprintf(" exit code %d", res.ExitCodes[len(res.ExitCodes)-1])
+	if n := len(res.ExitCodes); n > 1 {
+		s += fmt.Sprintf(" after %d runs", n)
+	}
+	if res.Stopped {
+		s += " (stopped)"
+	}
+	return s
+}
+
+// writeResults writes the results of the workloads, and the render they ran
+// in, to dir.
+func writeResults(dir string, results []*netdef.WorkloadResult, r *netdef.RenderedNetwork) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, "results.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(results); err != nil {
+		return err
+	}
+	return writeRender(filepath.Join(dir, "render.json"), r)
+}
+
+// printPlan prints a plan for people to read, one change per line.
+func printPlan(p *netdef.Plan, commands bool) {
+	if len(p.Changes) == 0 {
+		fmt.Println("No changes.")
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, ch := range p.Changes {
+		sym := map[string]string{"add": "+", "remove": "-", "update": "~"}[ch.Action]
+		fmt.Printf("%s %s %s", sym, ch.Kind, ch.Name)
+		if ch.Detail != "" {
+			fmt.Printf(": %s", ch.Detail)
+		}
+		fmt.Println()
+		counts[ch.Action]++
+	}
+	fmt.Printf("\nPlan: %d to add, %d to change, %d to remove.\n", counts["add"], counts["update"], counts["remove"])
+
+	if commands {
+		fmt.Println("\nCommands:")
+		for _, cmd := range p.Commands {
+			fmt.Println("  " + cmd)
+		}
+	}
+}
+
 func main() {
 	app := cli.NewApp()
 
 	create := cli.Command{
 		Name: "create",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "output",
 				Value: "config.render.json",
 				Usage: "Path to write out the rendered configuration",
 			},
-		},
+			cli.StringFlag{
+				Name:  "name",
+				Usage: "Register the network as a named instance instead of writing --output",
+			},
+			cli.StringFlag{
+				Name:  "bridge",
+				Usage: "Default bridge type for networks (ovs or linux)",
+			},
+			cli.BoolFlag{
+				Name:  "keep-partial",
+				Usage: "Keep whatever was created if creation fails, instead of deleting it",
+			},
+		}, runnerFlags...),
 		Action: func(c *cli.Context) error {
 			if c.Args().First() == "" {
 				return fmt.Errorf("must specify netdef configuration file")
@@ -58,49 +403,756 @@ func main() {
 				return err
 			}
 
-			r, err := cfg.Create()
+			if c.String("bridge") != "" {
+				cfg.Bridge = c.String("bridge")
+			}
+
+			output, ref := c.String("output"), c.String("output")
+			if name := c.String("name"); name != "" {
+				if output, err = newInstance(c, name); err != nil {
+					return err
+				}
+				ref = name
+			}
+
+			r := cfg.NewRenderedNetwork()
+			r.Name = c.String("name")
+			r.KeepPartial = c.Bool("keep-partial")
+			done, err := setupRunner(c, r)
 			if err != nil {
 				return err
 			}
+			defer done()
 
-			err = writeRender(c.String("output"), r)
+			closeJournal, err := openJournal(c, r, output, true)
 			if err != nil {
 				return err
 			}
+			defer closeJournal()
+			if err := registerRender(c, r, output); err != nil {
+				return err
+			}
+
+			if err := cfg.Render(r); err != nil {
+				if !c.Bool("dry-run") && !reportLeftovers(r, output, ref) {
+					netdef.UnregisterRender(r.ID)
+					if r.Name != "" {
+						removeInstance(output)
+					}
+				}
+				return err
+			}
+			if c.Bool("dry-run") {
+				return nil
+			}
 
+			err = writeRender(output, r)
+			if err != nil {
+				return err
+			}
+
+			// The render file now records everything the journal does.
+			os.Remove(journalPath(output))
 			return nil
 		},
 	}
 
 	cleanup := cli.Command{
 		Name: "cleanup",
+		Flags: append([]cli.Flag{
+			cli.BoolFlag{
+				Name:  "force",
+				Usage: "Keep deleting past failures and report all of them at the end",
+			},
+		}, runnerFlags...),
+		Action: func(c *cli.Context) error {
+			if c.Args().First() == "" {
+				return fmt.Errorf("must specify render file or instance")
+			}
+
+			path, instance := renderPath(c.Args().First())
+
+			// The render file is missing if creation was interrupted, and
+			// the journal records what apply changed since the render file
+			// was last written, if it was interrupted, so merge the two.
+			r, err := readRender(path)
+			haveRender := err == nil
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			jf, jerr := os.Open(journalPath(path))
+			switch {
+			case jerr == nil && haveRender:
+				err = r.ReplayJournal(jf)
+				jf.Close()
+			case jerr == nil:
+				r, err = netdef.ReadJournal(jf)
+				jf.Close()
+			case !os.IsNotExist(jerr):
+				return jerr
+			}
+			if err != nil {
+				return err
+			}
+
+			done, err := setupRunner(c, r)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			closeJournal, err := openJournal(c, r, path, false)
+			if err != nil {
+				return err
+			}
+			defer closeJournal()
+
+			before := trackedResources(r)
+			if c.Bool("force") {
+				err = r.ForceCleanup()
+			} else {
+				err = r.Cleanup()
+			}
+			after := trackedResources(r)
+
+			if deleted := before.minus(after).String(); deleted != "" {
+				fmt.Fprintln(os.Stderr, "deleted", deleted)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "left behind", after)
+				// The journal records what was deleted too, but keep the
+				// render file, if any, in step.
+				if haveRender && !c.Bool("dry-run") {
+					if werr := writeRender(path, r); werr != nil {
+						fmt.Fprintln(os.Stderr, "writing render file:", werr)
+					}
+				}
+				return err
+			}
+
+			if !c.Bool("dry-run") {
+				os.Remove(journalPath(path))
+				netdef.UnregisterRender(r.ID)
+				if instance {
+					removeInstance(path)
+				}
+			}
+			return nil
+		},
+	}
+
+	apply := cli.Command{
+		Name:      "apply",
+		Usage:     "Bring a rendered network in line with an edited configuration",
+		ArgsUsage: "<config> <render|instance>",
+		Flags:     runnerFlags,
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2 {
+				return fmt.Errorf("must specify netdef configuration file and render file or instance")
+			}
+
+			cfg, err := readConfig(c.Args().Get(0))
+			if err != nil {
+				return err
+			}
+
+			path, _ := renderPath(c.Args().Get(1))
+			r, err := readRender(path)
+			if err != nil {
+				return err
+			}
+
+			done, err := setupRunner(c, r)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			closeJournal, err := openJournal(c, r, path, false)
+			if err != nil {
+				return err
+			}
+			defer closeJournal()
+
+			changes, err := r.Apply(cfg)
+			for _, ch := range changes {
+				fmt.Fprintln(os.Stderr, ch)
+			}
+			if c.Bool("dry-run") {
+				return err
+			}
+
+			// Write the render even on failure, as it describes whatever
+			// exists now.
+			if werr := writeRender(path, r); werr != nil && err == nil {
+				err = werr
+			}
+			return err
+		},
+	}
+
+	plan := cli.Command{
+		Name:      "plan",
+		Usage:     "Show what create, or apply to an existing render, would change",
+		ArgsUsage: "<config> [render|instance]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "bridge",
+				Usage: "Default bridge type for networks (ovs or linux)",
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the plan as JSON",
+			},
+			cli.BoolFlag{
+				Name:  "commands",
+				Usage: "Also print the commands that would be run",
+			},
+			cli.StringFlag{
+				Name:  "name",
+				Usage: "Instance name create would be given, which hashed names are derived from",
+			},
+		},
 		Action: func(c *cli.Context) error {
 			if c.Args().First() == "" {
 				return fmt.Errorf("must specify netdef configuration file")
 			}
 
-			fi, err := os.Open(c.Args().First())
+			cfg, err := readConfig(c.Args().First())
+			if err != nil {
+				return err
+			}
+			if c.String("bridge") != "" {
+				cfg.Bridge = c.String("bridge")
+			}
+
+			var r *netdef.RenderedNetwork
+			if c.NArg() > 1 {
+				path, _ := renderPath(c.Args().Get(1))
+				r, err = readRender(path)
+				if err != nil {
+					return err
+				}
+			} else if c.String("name") != "" {
+				r = &netdef.RenderedNetwork{Name: c.String("name")}
+			}
+
+			p, err := cfg.Plan(r)
+			if err != nil {
+				return err
+			}
+
+			if c.Bool("json") {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(p)
+			}
+			printPlan(p, c.Bool("commands"))
+			return nil
+		},
+	}
+
+	setLink := cli.Command{
+		Name:      "set-link",
+		Usage:     "Change the link options of a peer's link to a network",
+		ArgsUsage: "<render|instance> <peer> <network>",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "latency",
+				Usage: "Latency of the link, e.g. 200ms",
+			},
+			cli.StringFlag{
+				Name:  "jitter",
+				Usage: "Jitter of the link, e.g. 10ms",
+			},
+			cli.StringFlag{
+				Name:  "bandwidth",
+				Usage: "Bandwidth of the link, e.g. 10mbit",
+			},
+			cli.StringFlag{
+				Name:  "loss",
+				Usage: "Packet loss of the link, e.g. 5%",
+			},
+		}, runnerFlags...),
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 3 {
+				return fmt.Errorf("must specify render file or instance, peer and network")
+			}
+
+			path, _ := renderPath(c.Args().Get(0))
+			r, err := readRender(path)
+			if err != nil {
+				return err
+			}
+
+			done, err := setupRunner(c, r)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			l := &netdef.LinkOpts{
+				Latency:    c.String("latency"),
+				Jitter:     c.String("jitter"),
+				Bandwidth:  c.String("bandwidth"),
+				PacketLoss: c.String("loss"),
+			}
+			if err := r.UpdateLink(c.Args().Get(1), c.Args().Get(2), l); err != nil {
+				return err
+			}
+			if c.Bool("dry-run") {
+				return nil
+			}
+
+			return writeRender(path, r)
+		},
+	}
+
+	partition := cli.Command{
+		Name:      "partition",
+		Usage:     "Split peers into groups that cannot reach each other",
+		ArgsUsage: "<render|instance> <peer,peer,...> <peer,peer,...> ...",
+		Flags:     runnerFlags,
+		Action: func(c *cli.Context) error {
+			if c.NArg() < 3 {
+				return fmt.Errorf("must specify render file or instance and at least two groups of peers")
+			}
+
+			path, _ := renderPath(c.Args().First())
+			r, err := readRender(path)
+			if err != nil {
+				return err
+			}
+
+			done, err := setupRunner(c, r)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			var groups [][]string
+			for _, g := range c.Args().Tail() {
+				groups = append(groups, strings.Split(g, ","))
+			}
+			// Save what was done even on failure, so that heal knows
+			// what to undo.
+			err = r.Partition(groups...)
+			if c.Bool("dry-run") {
+				return err
+			}
+			if werr := writeRender(path, r); err == nil {
+				err = werr
+			}
+			return err
+		},
+	}
+
+	heal := cli.Command{
+		Name:      "heal",
+		Usage:     "Remove a partition made by the partition command",
+		ArgsUsage: "<render|instance>",
+		Flags:     runnerFlags,
+		Action: func(c *cli.Context) error {
+			if c.Args().First() == "" {
+				return fmt.Errorf("must specify render file or instance")
+			}
+
+			path, _ := renderPath(c.Args().First())
+			r, err := readRender(path)
+			if err != nil {
+				return err
+			}
+
+			done, err := setupRunner(c, r)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			err = r.Heal()
+			if c.Bool("dry-run") {
+				return err
+			}
+			if werr := writeRender(path, r); err == nil {
+				err = werr
+			}
+			return err
+		},
+	}
+
+	run := cli.Command{
+		Name:      "run",
+		Usage:     "Create a network, run its workloads and schedule, and clean it up",
+		ArgsUsage: "<config>",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "output",
+				Value: "config.render.json",
+				Usage: "Path to write out the rendered configuration while running",
+			},
+			cli.StringFlag{
+				Name:  "name",
+				Usage: "Register the network as a named instance while running instead of writing --output",
+			},
+			cli.StringFlag{
+				Name:  "results",
+				Usage: "Directory to write the output and exit status of the workloads to",
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "Stop the run after this long, e.g. 5m",
+			},
+		}, runnerFlags...),
+		Action: func(c *cli.Context) error {
+			if c.Args().First() == "" {
+				return fmt.Errorf("must specify netdef configuration file")
+			}
+
+			cfg, err := readConfig(c.Args().First())
 			if err != nil {
 				return err
 			}
-			defer fi.Close()
 
-			var r netdef.RenderedNetwork
-			if err := json.NewDecoder(fi).Decode(&r); err != nil {
+			output := c.String("output")
+			if name := c.String("name"); name != "" {
+				if output, err = newInstance(c, name); err != nil {
+					return err
+				}
+			}
+
+			r := cfg.NewRenderedNetwork()
+			r.Name = c.String("name")
+			// A dry run prints the commands of the schedule without
+			// playing it out.
+			r.NoWait = c.Bool("dry-run")
+			done, err := setupRunner(c, r)
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			closeJournal, err := openJournal(c, r, output, true)
+			if err != nil {
+				return err
+			}
+			defer closeJournal()
+			if err := registerRender(c, r, output); err != nil {
+				return err
+			}
+
+			// Clean up whatever was created, however we leave. The render
+			// file is kept if that fails so cleanup can be retried.
+			wrote := false
+			defer func() {
+				if err := r.Cleanup(); err != nil {
+					fmt.Fprintln(os.Stderr, "cleanup failed:", err)
+					return
+				}
+				if wrote {
+					os.Remove(output)
+				}
+				if !c.Bool("dry-run") {
+					os.Remove(journalPath(output))
+					netdef.UnregisterRender(r.ID)
+					if r.Name != "" {
+						removeInstance(output)
+					}
+				}
+			}()
+
+			if err := cfg.Render(r); err != nil {
 				return err
 			}
+			if !c.Bool("dry-run") {
+				if err := writeRender(output, r); err != nil {
+					return err
+				}
+				wrote = true
+				// The render file now records everything the journal
+				// does.
+				os.Remove(journalPath(output))
+			}
+
+			var timeout <-chan time.Time
+			if d := c.Duration("timeout"); d > 0 {
+				t := time.NewTimer(d)
+				defer t.Stop()
+				timeout = t.C
+			}
+			stop := make(chan struct{})
+			timedOut := false
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(sigs)
+			schedFailed := make(chan struct{})
+			go func() {
+				select {
+				case <-sigs:
+				case <-timeout:
+					timedOut = true
+				case <-schedFailed:
+				}
+				close(stop)
+			}()
+
+			// The schedule plays alongside the workloads, if there are
+			// any, and is cut short when they finish. If it fails, the
+			// workloads are stopped.
+			schedStop := make(chan struct{})
+			schedDone := make(chan struct{})
+			var schedErr error
+			go func() {
+				schedErr = r.RunSchedule(cfg, schedStop)
+				if schedErr != nil {
+					close(schedFailed)
+				}
+				close(schedDone)
+			}()
 
-			if err := r.Cleanup(); err != nil {
+			workloads := hasWorkloads(cfg)
+			if workloads && c.Bool("dry-run") {
+				fmt.Fprintln(os.Stderr, "workloads are not run on a dry run")
+				workloads = false
+			}
+			var results []*netdef.WorkloadResult
+			if workloads {
+				results, err = r.RunWorkloads(cfg, c.String("results"), stop)
+			} else {
+				select {
+				case <-schedDone:
+				case <-stop:
+				}
+			}
+			close(schedStop)
+			<-schedDone
+			if err != nil {
 				return err
 			}
 
+			failed := 0
+			for _, res := range results {
+				fmt.Fprintln(os.Stderr, describeResult(res))
+				if res.Failed() {
+					failed++
+				}
+			}
+			if c.String("results") != "" && !c.Bool("dry-run") {
+				if err := writeResults(c.String("results"), results, r); err != nil {
+					return err
+				}
+			}
+
+			if schedErr != nil {
+				return schedErr
+			}
+
+			// stop is closed by now if the run was cut short.
+			select {
+			case <-stop:
+				if timedOut {
+					return fmt.Errorf("timed out after %s", c.Duration("timeout"))
+				}
+			default:
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d workloads failed", failed)
+			}
 			return nil
 		},
 	}
 
+	execCmd := cli.Command{
+		Name:            "exec",
+		Usage:           "Run a command in the namespace of a peer",
+		ArgsUsage:       "<render|instance> <peer> [--] <command> [args...]",
+		SkipFlagParsing: true,
+		Action: func(c *cli.Context) error {
+			args := c.Args()
+			if len(args) > 2 && args[2] == "--" {
+				args = append(args[:2:2], args[3:]...)
+			}
+			if len(args) < 3 {
+				return fmt.Errorf("must specify render file or instance, peer and command")
+			}
+
+			path, _ := renderPath(args[0])
+			r, err := readRender(path)
+			if err != nil {
+				return err
+			}
+
+			cmd, err := r.Command(args[1], args[2], args[3:]...)
+			if err != nil {
+				return err
+			}
+			return runInPeer(cmd)
+		},
+	}
+
+	shell := cli.Command{
+		Name:      "shell",
+		Usage:     "Start an interactive shell in the namespace of a peer",
+		ArgsUsage: "[render|instance] <peer>",
+		Action: func(c *cli.Context) error {
+			render, peer := "config.render.json", c.Args().First()
+			switch c.NArg() {
+			case 1:
+			case 2:
+				render, peer = c.Args().Get(0), c.Args().Get(1)
+			default:
+				return fmt.Errorf("must specify peer, optionally after a render file or instance")
+			}
+
+			path, _ := renderPath(render)
+			r, err := readRender(path)
+			if err != nil {
+				return err
+			}
+
+			sh := os.Getenv("SHELL")
+			if sh == "" {
+				sh = "/bin/sh"
+			}
+			// bash would replace the prompt with the one from .bashrc.
+			var args []string
+			if filepath.Base(sh) == "bash" {
+				args = append(args, "--norc")
+			}
+			cmd, err := r.Command(peer, sh, args...)
+			if err != nil {
+				return err
+			}
+			cmd.Env = append(os.Environ(), "NETDEF_PEER="+peer, fmt.Sprintf("PS1=[%s] \\w \\$ ", peer))
+			return runInPeer(cmd)
+		},
+	}
+
+	ls := cli.Command{
+		Name:  "ls",
+		Usage: "List the named instances on this host",
+		Action: func(c *cli.Context) error {
+			instances, err := netdef.Instances()
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tSTATE\tPEERS\tNETWORKS\tCREATED")
+			for _, inst := range instances {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", inst.Name, inst.State, inst.Peers, inst.Networks, inst.Created.Format(time.RFC3339))
+			}
+			return w.Flush()
+		},
+	}
+
+	gc := cli.Command{
+		Name:  "gc",
+		Usage: "Delete what netdef created for networks whose render is lost",
+		Flags: append([]cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "keep",
+				Usage: "Render file of a network to leave alone, in addition to registered instances; may be repeated",
+			},
+			cli.StringSliceFlag{
+				Name:  "prefix",
+				Usage: "Only delete resources whose name starts with this prefix; may be repeated",
+			},
+			cli.StringFlag{
+				Name:  "config",
+				Usage: "Only delete resources named with the prefixes of this configuration",
+			},
+			cli.DurationFlag{
+				Name:  "older-than",
+				Usage: "Only delete resources created at least this long ago, or of any age if 0",
+				Value: time.Hour,
+			},
+			cli.BoolFlag{
+				Name:  "list",
+				Usage: "List what would be deleted without deleting it",
+			},
+		}, runnerFlags...),
+		Action: func(c *cli.Context) error {
+			col := &netdef.Collector{
+				Keep:     make(map[string]bool),
+				Prefixes: c.StringSlice("prefix"),
+				MinAge:   c.Duration("older-than"),
+			}
+
+			// Borrow the runner and backend the flags select.
+			r := &netdef.RenderedNetwork{}
+			done, err := setupRunner(c, r)
+			if err != nil {
+				return err
+			}
+			defer done()
+			col.Runner, col.Backend = r.Runner, r.Backend
+
+			// Hold the lock so that no network is being created while
+			// the instances are listed and their resources are deleted.
+			if !c.Bool("dry-run") {
+				unlock, err := netdef.LockHost()
+				if err != nil {
+					return err
+				}
+				defer unlock()
+			}
+
+			instances, err := netdef.Instances()
+			if err != nil {
+				return err
+			}
+			for _, inst := range instances {
+				if inst.ID != "" {
+					col.Keep[inst.ID] = true
+				}
+			}
+			for _, path := range c.StringSlice("keep") {
+				r, err := readRender(path)
+				if err != nil {
+					return err
+				}
+				if r.ID == "" {
+					return fmt.Errorf("render file %s has no ID", path)
+				}
+				col.Keep[r.ID] = true
+			}
+			if c.String("config") != "" {
+				cfg, err := readConfig(c.String("config"))
+				if err != nil {
+					return err
+				}
+				col.Prefixes = append(col.Prefixes, cfg.NamePrefixes()...)
+			}
+
+			if c.Bool("list") {
+				found, err := col.Find()
+				for _, o := range found {
+					fmt.Println(o)
+				}
+				return err
+			}
+
+			deleted, err := col.Collect()
+			for _, o := range deleted {
+				fmt.Fprintln(os.Stderr, "deleted", o)
+			}
+			return err
+		},
+	}
+
 	app.Commands = []cli.Command{
 		create,
 		cleanup,
+		apply,
+		plan,
+		setLink,
+		partition,
+		heal,
+		run,
+		execCmd,
+		shell,
+		ls,
+		gc,
 	}
 
 	app.RunAndExitOnError()
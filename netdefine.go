@@ -1,17 +1,13 @@
 package netdef
 
 import (
-	"bufio"
-	"bytes"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"math/big"
-	"net"
-	"os"
+	"io"
 	"os/exec"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -33,75 +29,6 @@ func callBin(args ...string) error {
 	return nil
 }
 
-// freshInterfaceName creates a unique interface name based on prefix that does
-// not collide with any existing interfaces.
-func freshInterfaceName(prefix string) (string, error) {
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return "", err
-	}
-	names := make([]string, len(ifaces))
-	for i, iface := range ifaces {
-		names[i] = iface.Name
-	}
-	return freshName(prefix, names), nil
-}
-
-var vethRegexp = regexp.MustCompile(`^[0-9]+: ([a-z0-9]+)(@[a-z0-9]+)?:.+`)
-
-// getVethNames is a helper function to poll for veth interfaces.
-func getVethNames() ([]string, error) {
-	cmd := exec.Command("ip", "link", "show", "type", "veth")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, err
-	}
-	buf := bytes.NewReader(out)
-	scanner := bufio.NewScanner(buf)
-	ret := make([]string, 0)
-	for scanner.Scan() {
-		match := vethRegexp.FindStringSubmatch(scanner.Text())
-		if match != nil {
-			ret = append(ret, match[1])
-		}
-	}
-	return ret, nil
-}
-
-// freshVethName creates a unique veth name based on prefix that does not
-// collide with any existing veths.
-func freshVethName(prefix string) (string, error) {
-	names, err := getVethNames()
-	if err != nil {
-		return "", err
-	}
-	return freshName(prefix, names), nil
-}
-
-// freshNamespaceName creates a unique netns name that does not collide with any
-// exising namespaces.
-func freshNamespaceName(prefix string) (string, error) {
-	files, err := ioutil.ReadDir("/var/run/netns")
-	if err == nil {
-		// Successfully opened the directory
-		names := make([]string, len(files))
-		for i, file := range files {
-			if file.IsDir() {
-				continue
-			}
-			names[i] = file.Name()
-		}
-		return freshName(prefix, names), nil
-	} else if os.IsNotExist(err) {
-		// Directory doesn't exist, assume there are no namespaces
-		names := make([]string, 0)
-		return freshName(prefix, names), nil
-	} else {
-		// Real error
-		return "", err
-	}
-}
-
 // freshName generates a new name based on prefix that does not collide with any
 // names in existing.
 func freshName(prefix string, existing []string) string {
@@ -127,82 +54,198 @@ func freshName(prefix string, existing []string) string {
 }
 
 func (r *RenderedNetwork) freshNetworkName(name string) (string, error) {
-	bridgename, err := r.freshInterfaceName("Bridge")
+	bridgename, err := r.freshInterfaceName("Bridge", "network "+name)
 	if err != nil {
 		return "", err
 	}
-	r.subnets[name] = bridgename
+	r.Networks[name] = bridgename
 	return bridgename, nil
 }
 
-func (r *RenderedNetwork) freshInterfaceName(typ string) (string, error) {
-	prefix := r.prefixes[typ]
-	bridgename, err := freshInterfaceName(prefix)
+// freshInterfaceName picks a name for an interface that does not collide with
+// any interface in the global namespace.
+func (r *RenderedNetwork) freshInterfaceName(typ, logical string) (string, error) {
+	return r.pickName(typ, logical, func() ([]string, error) {
+		return r.interfaceNames(hostInterfaceNames)
+	})
+}
+
+// freshVethName picks a name for a veth. With sequential naming, only other
+// veths are considered.
+func (r *RenderedNetwork) freshVethName(typ, logical string) (string, error) {
+	return r.pickName(typ, logical, func() ([]string, error) {
+		if r.naming == NamingHashed {
+			return r.interfaceNames(hostInterfaceNames)
+		}
+		return r.interfaceNames(r.backend().VethNames)
+	})
+}
+
+// ovsInterfaceNames lists the interfaces openvswitch knows of, including its
+// bridges, which need not exist in the global namespace. It returns nil if
+// openvswitch is not installed.
+func (r *RenderedNetwork) ovsInterfaceNames() ([]string, error) {
+	if _, err := exec.LookPath("ovs-vsctl"); err != nil {
+		return nil, nil
+	}
+	out, err := r.runner().Output("ovs-vsctl", "--format=csv", "--data=bare", "--no-headings", "--columns=name", "list", "interface")
 	if err != nil {
-		return "", err
+		return nil, errors.Wrap(err, "listing openvswitch interfaces")
 	}
-	return bridgename, nil
+	return strings.Fields(string(out)), nil
 }
 
-func (r *RenderedNetwork) freshVethName(typ string) (string, error) {
-	prefix := r.prefixes[typ]
-	bridgename, err := freshVethName(prefix)
-	if err != nil {
-		return "", err
+// take marks name as handed out so that it is not generated again, even if it
+// does not exist on the host yet (e.g. when the Runner only prints commands).
+func (r *RenderedNetwork) take(name string) {
+	if r.taken == nil {
+		r.taken = make(map[string]struct{})
 	}
-	return bridgename, nil
+	r.taken[name] = struct{}{}
+}
+
+func (r *RenderedNetwork) takenNames() []string {
+	names := make([]string, 0, len(r.taken))
+	for name := range r.taken {
+		names = append(names, name)
+	}
+	return names
+}
+
+// runner returns the Runner used to modify the host.
+func (r *RenderedNetwork) runner() Runner {
+	if r.Runner == nil {
+		return ExecRunner{}
+	}
+	return r.Runner
+}
+
+func (r *RenderedNetwork) run(args ...string) error {
+	return r.runner().Run(args...)
+}
+
+// backend returns the Backend used to manage namespaces and veths.
+func (r *RenderedNetwork) backend() Backend {
+	if r.Backend == nil {
+		return &IPBackend{Runner: r.runner()}
+	}
+	return r.Backend
 }
 
-// CreateNamespace creates a unique namespace and, if successful, logs a mapping
-// of the configuration name to the generated namespace name.
+// CreateNamespace creates a unique namespace and, once it exists, logs a
+// mapping of the configuration name to the generated namespace name.
 func (r *RenderedNetwork) CreateNamespace(name string) error {
-	freshname, err := freshNamespaceName(r.prefixes["Namespace"])
+	return r.createNamespace("Namespace", "peer "+name, func(ns string) {
+		r.Namespaces[name] = ns
+	})
+}
+
+// createNamespace creates a namespace named with the prefix for typ, for the
+// thing described by logical. record is called as soon as the namespace
+// exists, so that it is tracked even if marking it fails.
+func (r *RenderedNetwork) createNamespace(typ, logical string, record func(ns string)) error {
+	freshname, err := r.pickName(typ, logical, namespaceNames)
 	if err != nil {
 		return err
 	}
-	err = callBin("ip", "netns", "add", freshname)
-	if err == nil {
-		r.Namespaces[name] = freshname
+	r.take(freshname)
+	res := resource{Kind: resNamespace, Name: freshname}
+	if err := r.track(res, func() error { return r.backend().AddNamespace(freshname) }); err != nil {
+		return err
 	}
-	return err
+	record(freshname)
+	if err := r.markNamespace(freshname); err != nil {
+		return errors.Wrap(err, "marking namespace")
+	}
+	return nil
 }
 
-// DeleteNamespace deletes an internet namespace.
+// DeleteNamespace terminates the processes in an internet namespace and deletes
+// it. A namespace that is already gone counts as deleted.
 func (r *RenderedNetwork) DeleteNamespace(name string) error {
-	err := callBin("ip", "netns", "del", name)
+	if err := r.killProcesses(name); err != nil {
+		return err
+	}
+	err := r.backend().DeleteNamespace(name)
+	if isGone(err) {
+		err = nil
+	}
+	if err == nil {
+		r.forgetNamespace(name)
+		delete(r.Names, name)
+		err = r.journal(opDelete, resource{Kind: resNamespace, Name: name}, "")
+	}
 	if err == nil {
-		delete(r.Namespaces, name)
+		err = r.unmarkNamespace(name)
 	}
 	return err
 }
 
-// CreateBridge creates a new bridge with openvswitch.
+// CreateBridge creates a new bridge of the default type, which is openvswitch
+// unless the Config says otherwise.
 func (r *RenderedNetwork) CreateBridge(name string) error {
-	err := callBin("ovs-vsctl", "add-br", name)
-	if err == nil {
-		r.Bridges[name] = struct{}{}
+	return r.CreateBridgeOfType(name, r.bridge)
+}
+
+// CreateBridgeOfType creates a new bridge with the driver for typ.
+func (r *RenderedNetwork) CreateBridgeOfType(name, typ string) error {
+	if typ == "" {
+		typ = BridgeOVS
 	}
-	return err
+	res := resource{Kind: resBridge, Name: name, Type: typ}
+	err := r.track(res, func() error { return r.bridgeDriver(typ).CreateBridge(name) })
+	if err != nil {
+		return err
+	}
+	r.Bridges[name] = struct{}{}
+	if r.BridgeTypes == nil {
+		r.BridgeTypes = make(map[string]string)
+	}
+	r.BridgeTypes[name] = typ
+
+	if typ == BridgeOVS {
+		err = r.tagOVS("bridge", name)
+	} else {
+		err = r.tagLink(name)
+	}
+	return errors.Wrap(err, "tagging bridge")
 }
 
-// DeleteBridge deletes a bridge with openvswitch.
+// DeleteBridge deletes a bridge with the driver it was created with. A bridge
+// that is already gone counts as deleted.
 func (r *RenderedNetwork) DeleteBridge(name string) error {
-	err := callBin("ovs-vsctl", "del-br", name)
+	typ := r.bridgeType(name)
+	err := r.bridgeDriver(typ).DeleteBridge(name)
+	if isGone(err) {
+		err = nil
+	}
 	if err == nil {
 		delete(r.Bridges, name)
+		delete(r.BridgeTypes, name)
+		r.forgetBridge(name)
+		delete(r.Names, name)
+		err = r.journal(opDelete, resource{Kind: resBridge, Name: name, Type: typ}, "")
 	}
 	return err
 }
 
-// BridgeAddPort adds a port to an openvswitch bridge.
+// BridgeAddPort adds a port to a bridge. Ports of openvswitch bridges are
+// tagged with the owner of r.
 func (r *RenderedNetwork) BridgeAddPort(bridge, ifname string) error {
-	return callBin("ovs-vsctl", "add-port", bridge, ifname)
+	typ := r.bridgeType(bridge)
+	if err := r.bridgeDriver(typ).AddPort(bridge, ifname); err != nil {
+		return err
+	}
+	if typ == BridgeOVS {
+		return errors.Wrap(r.tagOVS("port", ifname), "tagging port")
+	}
+	return nil
 }
 
 // PortSetParameter sets a variable for a given port.
 func (r *RenderedNetwork) PortSetParameter(port, param, val string) error {
 	typeStr := fmt.Sprintf("%s=%s", param, val)
-	return callBin("ovs-vsctl", "set", "interface", port, typeStr)
+	return r.run("ovs-vsctl", "set", "interface", port, typeStr)
 }
 
 // PortSetOption sets an option for a given port.
@@ -211,95 +254,175 @@ func (r *RenderedNetwork) PortSetOption(port, option, peer string) error {
 	return r.PortSetParameter(port, param, peer)
 }
 
-// PatchBridges creates patch ports on two interfaces and peers them,
-// effectively connecting two openvswitch bridges.
+// BridgeRemovePort detaches an interface from a bridge.
+func (r *RenderedNetwork) BridgeRemovePort(bridge, ifname string) error {
+	return r.bridgeDriver(r.bridgeType(bridge)).RemovePort(bridge, ifname)
+}
+
+// PatchBridges connects two bridges. Two openvswitch bridges are connected
+// with peered patch ports; any other combination is connected with a veth pair.
 func (r *RenderedNetwork) PatchBridges(a, b string, l *LinkOpts) error {
-	ab, err := r.freshVethName("Port")
+	_, err := r.patchBridges(a, b, l)
+	return err
+}
+
+// patchBridges is PatchBridges, returning a record of the patch.
+func (r *RenderedNetwork) patchBridges(a, b string, l *LinkOpts) (*Patch, error) {
+	if r.bridgeType(a) != BridgeOVS || r.bridgeType(b) != BridgeOVS {
+		return r.vethPatchBridges(a, b, l)
+	}
+
+	ab, err := r.freshVethName("Port", fmt.Sprintf("patch %s:%s port", a, b))
 	if err != nil {
-		return errors.Wrap(err, "creating fresh port name")
+		return nil, errors.Wrap(err, "creating fresh port name")
 	}
 	if err = r.CreateVeth(ab); err != nil {
-		return errors.Wrap(err, "creating port")
+		return nil, errors.Wrap(err, "creating port")
 	}
-	ba, err := r.freshVethName("Port")
+	ba, err := r.freshVethName("Port", fmt.Sprintf("patch %s:%s port", b, a))
 	if err != nil {
-		return errors.Wrap(err, "creating fresh port name")
+		return nil, errors.Wrap(err, "creating fresh port name")
 	}
 	if err = r.CreateVeth(ba); err != nil {
-		return errors.Wrap(err, "creating port")
+		return nil, errors.Wrap(err, "creating port")
 	}
 	if err = r.BridgeAddPort(a, ab); err != nil {
-		return errors.Wrap(err, "adding port")
+		return nil, errors.Wrap(err, "adding port")
 	}
 	if err = r.PortSetParameter(ab, "type", "patch"); err != nil {
-		return errors.Wrap(err, "configuring port type")
+		return nil, errors.Wrap(err, "configuring port type")
 	}
 	if err = r.PortSetOption(ab, "peer", ba); err != nil {
-		return errors.Wrap(err, "configuring port options")
+		return nil, errors.Wrap(err, "configuring port options")
 	}
 	if err = r.BridgeAddPort(b, ba); err != nil {
-		return errors.Wrap(err, "adding port")
+		return nil, errors.Wrap(err, "adding port")
 	}
 	if err = r.PortSetParameter(ba, "type", "patch"); err != nil {
-		return errors.Wrap(err, "configuring port type")
+		return nil, errors.Wrap(err, "configuring port type")
 	}
 	if err = r.PortSetOption(ba, "peer", ab); err != nil {
-		return errors.Wrap(err, "configuring port options")
+		return nil, errors.Wrap(err, "configuring port options")
 	}
 	if l != nil {
-		if err = l.Apply(ab); err != nil {
-			return errors.Wrap(err, "setting patch link options")
+		if err = r.applyLink(ab, l); err != nil {
+			return nil, errors.Wrap(err, "setting patch link options")
 		}
 	}
 
-	return nil
+	return &Patch{Bridges: []string{a, b}, Ports: []string{ab, ba}, Link: l}, nil
+}
+
+// vethPatchBridges connects two bridges with a veth pair, one end attached to
+// each bridge.
+func (r *RenderedNetwork) vethPatchBridges(a, b string, l *LinkOpts) (*Patch, error) {
+	ab, err := r.freshVethName("Patch", fmt.Sprintf("patch %s:%s", a, b))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating fresh patch name")
+	}
+	ba, err := r.freshVethName("Patch", fmt.Sprintf("patch %s:%s", b, a))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating fresh patch name")
+	}
+	if err = r.CreateVethPair(ab, ba); err != nil {
+		return nil, errors.Wrap(err, "creating patch veth pair")
+	}
+	// Deleting either end of the pair deletes both, so only track one.
+	delete(r.Interfaces, ba)
+	if err = r.BridgeAddPort(a, ab); err != nil {
+		return nil, errors.Wrap(err, "adding port")
+	}
+	if err = r.BridgeAddPort(b, ba); err != nil {
+		return nil, errors.Wrap(err, "adding port")
+	}
+	if err = r.SetDev(ab, "up"); err != nil {
+		return nil, err
+	}
+	if err = r.SetDev(ba, "up"); err != nil {
+		return nil, err
+	}
+	if err = r.applyLink(ab, l); err != nil {
+		return nil, errors.Wrap(err, "setting patch link options")
+	}
+
+	return &Patch{Bridges: []string{a, b}, Ports: []string{ab, ba}, Link: l}, nil
 }
 
 // NetNsExec executes a command within a network namespace.
 func (r *RenderedNetwork) NetNsExec(ns string, cmdn string, nsargs ...string) error {
 	args := []string{"ip", "netns", "exec", ns, cmdn}
 	args = append(args, nsargs...)
-	return callBin(args...)
+	return r.run(args...)
 }
 
 // SetDev updates the state of a network device.
 func (r *RenderedNetwork) SetDev(dev string, state string) error {
-	return callBin("ip", "link", "set", "dev", dev, state)
+	return r.backend().SetLinkState("", dev, state)
+}
+
+// SetDevMAC sets the hardware address of a network device.
+func (r *RenderedNetwork) SetDevMAC(dev, mac string) error {
+	return r.backend().SetLinkMAC(dev, mac)
+}
+
+// SetNsDev updates the state of a network device within a namespace.
+func (r *RenderedNetwork) SetNsDev(ns, dev, state string) error {
+	return r.backend().SetLinkState(ns, dev, state)
+}
+
+// AddNsAddr assigns an address in CIDR notation to a network device within a
+// namespace.
+func (r *RenderedNetwork) AddNsAddr(ns, dev, cidr string) error {
+	return r.backend().AddAddr(ns, dev, cidr)
 }
 
 // CreateVeth creates a new veth interface.
 func (r *RenderedNetwork) CreateVeth(a string) error {
-	err := callBin("ip", "link", "add", a, "type", "veth")
-	if err == nil {
-		r.Interfaces[a] = struct{}{}
+	err := r.track(resource{Kind: resVeth, Name: a}, func() error { return r.backend().AddVeth(a) })
+	if err != nil {
+		return err
 	}
-	return err
+	r.Interfaces[a] = struct{}{}
+	return errors.Wrap(r.tagLink(a), "tagging veth")
 }
 
 // CreateVethPair creates a new pair of veth interfaces that are connected.
 func (r *RenderedNetwork) CreateVethPair(a, b string) error {
-	err := callBin("ip", "link", "add", a, "type", "veth", "peer", "name", b)
-	if err == nil {
-		r.Interfaces[a] = struct{}{}
-		r.Interfaces[b] = struct{}{}
+	err := r.track(resource{Kind: resVethPair, Name: a, Peer: b}, func() error { return r.backend().AddVethPair(a, b) })
+	if err != nil {
+		return err
 	}
-	return err
+	r.Interfaces[a] = struct{}{}
+	r.Interfaces[b] = struct{}{}
+	for _, name := range []string{a, b} {
+		if err := r.tagLink(name); err != nil {
+			return errors.Wrap(err, "tagging veth")
+		}
+	}
+	return nil
 }
 
-// DeleteInterface deletes a network interface.
+// DeleteInterface deletes a network interface. An interface that is already
+// gone counts as deleted.
 func (r *RenderedNetwork) DeleteInterface(name string) error {
-	err := callBin("ip", "link", "del", name)
+	err := r.backend().DeleteLink(name)
+	if isGone(err) {
+		err = nil
+	}
 	if err == nil {
 		delete(r.Interfaces, name)
+		delete(r.Names, name)
+		err = r.journal(opDelete, resource{Kind: resVeth, Name: name}, "")
 	}
 	return err
 }
 
 // AssignVethToNamespace moves a veth into a network namespace.
 func (r *RenderedNetwork) AssignVethToNamespace(veth, ns string) error {
-	err := callBin("ip", "link", "set", veth, "netns", ns)
+	err := r.backend().SetLinkNamespace(veth, ns)
 	if err == nil {
 		delete(r.Interfaces, veth)
+		err = r.journal(opMove, resource{Kind: resVeth, Name: veth}, ns)
 	}
 	return err
 }
@@ -321,55 +444,174 @@ type Config struct {
 	// - Patch (default "patch")
 	// - Port (default "tap")
 	// - Namespace (default "ns")
+	// - Router (default "rt")
+	// - Nat (default "nat")
 	Prefixes map[string]string
+	// Bridge is the default type of bridge created for networks, either
+	// "ovs" (the default) or "linux".
+	Bridge string
+	// Schedule is a timeline of changes to peer links, played by
+	// RenderedNetwork.RunSchedule once the network is created.
+	Schedule []Event
+	// Naming is how bridges, veths and namespaces are named, either
+	// "sequential" (the default) or "hashed". Hashed names are the same
+	// every time the config is rendered under the same instance name.
+	Naming string
 }
 
 // Network describes a subnet configuration.
 type Network struct {
 	// Name of the subnet, used only in configuration, not actual rendering.
 	Name string
-	// IpRange is a string representation of a class C or D IP range.
+	// IpRange is a string representation of an IPv4 or IPv6 range in CIDR
+	// notation.
 	IpRange string
+	// IpRange6 is an optional IPv6 range for dual-stack networks, in which
+	// case IpRange must be IPv4. Every peer linked to a dual-stack network
+	// gets one address from each range.
+	IpRange6 string
 	// Links is a map of subnets this network is connected to to the link
 	// options that describe the physical qualities of the link.
 	Links map[string]*LinkOpts
 	// BindMask is a default subnet mask for all peers created on this network.
 	BindMask string
-
-	ipnet  *net.IPNet
-	nextIp int64
+	// Bridge is the type of bridge created for this network, overriding
+	// Config.Bridge.
+	Bridge string
+
+	// Gateway is an address reserved for a gateway, which is never assigned
+	// to a peer.
+	Gateway string
+	// Reserved lists addresses that are not handed out automatically but may
+	// still be assigned statically through LinkOpts.Address. Entries may be
+	// single addresses, CIDR blocks or ranges like "10.1.1.10-10.1.1.20".
+	Reserved []string
+	// Exclude lists addresses that are never assigned, in the same format
+	// as Reserved.
+	Exclude []string
+	// Nat puts the network behind a NAT router connected to another
+	// network. Peers on the network get a default route through it. The NAT
+	// router uses Gateway as its inside address if it is set.
+	Nat *NatOpts
+
+	pool  *addrPool
+	pool6 *addrPool
 }
 
 // RenderedNetwork describes the actual changes made to a host operating system
 // in executing a configuration. This exists primarily for cleaning up rendered
 // network configurations.
 type RenderedNetwork struct {
+	// ID identifies the network on the host. Everything created for it is
+	// tagged with the ID, so that gc can find what was created by networks
+	// whose render is lost.
+	ID string
+	// Name is the name of the instance the network was registered as, if
+	// any.
+	Name string
+	// Created is when the network was first rendered.
+	Created time.Time
 	// Bridges is a set of bridges created by a Config.
 	Bridges map[string]struct{}
+	// BridgeTypes maps bridges to the type they were created with. Bridges
+	// missing from it are openvswitch bridges.
+	BridgeTypes map[string]string
 	// Namespaces is a map of peer names to the namespaces created for them.
 	Namespaces map[string]string
+	// Networks is a map of network names to the bridges created for them.
+	Networks map[string]string
+	// PeerLinks maps peer names and then network names to a record of how
+	// the peer was connected to the network.
+	PeerLinks map[string]map[string]*PeerLink
+	// Routers is a map of routed network links, named "a:b", to the
+	// namespaces created for them.
+	Routers map[string]string
+	// RouterLinks maps router names and then network names to a record of
+	// how the router was connected to the network.
+	RouterLinks map[string]map[string]*PeerLink
+	// Partitions holds the groups of the current partition made by
+	// Partition, if any.
+	Partitions [][]string
+	// Nats is a map of network names to the namespaces created for their
+	// NAT routers.
+	Nats map[string]string
+	// NatLinks maps network names and then network names to a record of how
+	// the network's NAT router was connected to each side.
+	NatLinks map[string]map[string]*PeerLink
+	// Patches maps links between networks that are not routed, named "a:b",
+	// to a record of how their bridges were patched together.
+	Patches map[string]*Patch
+	// Names maps the names of the bridges, veths and namespaces created to
+	// what they were created for, e.g. "peer wolf on seattle port".
+	Names map[string]string
 	// Interfaces ia set of veths created in the global namespace. Typically
 	// these will all be ports to openvswitch bridges.
 	Interfaces map[string]struct{}
+	// Config is the configuration the network was last rendered or applied
+	// from, used by Apply to work out what changed.
+	Config *Config
+	// Processes lists the processes started with Start that have not been
+	// waited for.
+	Processes []*ProcessRecord
+
+	// Runner executes the commands that modify the host. If nil, commands
+	// are executed directly.
+	Runner Runner `json:"-"`
+	// Backend manages namespaces, veths and addresses. If nil, an
+	// IPBackend using Runner is used.
+	Backend Backend `json:"-"`
+	// Journal, if set, receives a line for every bridge, namespace and veth
+	// as it is created, moved or deleted. ReadJournal turns it back into a
+	// RenderedNetwork that can be rolled back, even if the process that
+	// wrote it died midway.
+	Journal io.Writer `json:"-"`
+	// KeepPartial stops Render from deleting what it created when it fails,
+	// e.g. to inspect the host after the failure.
+	KeepPartial bool `json:"-"`
+	// NoWait makes RunSchedule apply every event at once instead of at its
+	// time, e.g. to print the commands of a schedule on a dry run.
+	NoWait bool `json:"-"`
+
+	resources []resource
+	procLk    sync.Mutex
+	prefixes  map[string]string
+	taken     map[string]struct{}
+	bridge    string
+	naming    string
+}
 
-	subnets  map[string]string
-	prefixes map[string]string
+// Patch records how the bridges of two networks were connected.
+type Patch struct {
+	// Bridges are the two bridges that were patched.
+	Bridges []string
+	// Ports holds the interface attached to each of Bridges.
+	Ports []string
+	// Link holds the link options applied to the first port, if any.
+	Link *LinkOpts
 }
 
 // NewRenderedNetwork initializes a RenderedNetwork based on the prefixes
 // supplied by the Config.
 func (c *Config) NewRenderedNetwork() *RenderedNetwork {
 	r := &RenderedNetwork{
-		Bridges:    make(map[string]struct{}),
-		Namespaces: make(map[string]string),
-		Interfaces: make(map[string]struct{}),
-		subnets:    make(map[string]string),
+		ID:          newID(),
+		Bridges:     make(map[string]struct{}),
+		BridgeTypes: make(map[string]string),
+		Namespaces:  make(map[string]string),
+		Interfaces:  make(map[string]struct{}),
+		Networks:    make(map[string]string),
+		PeerLinks:   make(map[string]map[string]*PeerLink),
+		taken:       make(map[string]struct{}),
+		bridge:      c.Bridge,
+		naming:      c.Naming,
 		prefixes: map[string]string{
 			"Bridge":    "br",
 			"Interface": "veth",
 			"Patch":     "patch",
 			"Port":      "tap",
 			"Namespace": "ns",
+			"Router":    "rt",
+			"Nat":       "nat",
 		},
 	}
 
@@ -382,29 +624,40 @@ func (c *Config) NewRenderedNetwork() *RenderedNetwork {
 	return r
 }
 
-// GetNextIp returns the next IPv4 address in the Network's IpRange.
+// GetNextIp returns the next free address in the Network's IpRange, which may
+// be IPv4 or IPv6. The mask only applies to IPv4 ranges.
 func (n *Network) GetNextIp(mask string) (string, error) {
-	ip := n.ipnet.IP
-
-	// TODO: better algorithm for this all. github.com/apparentlymart/go-cidr looks decent
-	n.nextIp++
+	if err := n.initPools(); err != nil {
+		return "", err
+	}
 
-	ipn := big.NewInt(0).SetBytes([]byte(ip))
-	ipn.Add(ipn, big.NewInt(n.nextIp))
+	ip, err := n.pool.allocate("GetNextIp")
+	if err != nil {
+		return "", fmt.Errorf("network %s: %s", n.Name, err)
+	}
+	return n.pool.format(ip, mask, n.BindMask), nil
+}
 
-	b := ipn.Bytes()
-	subnetMask := net.IPMask(net.ParseIP(mask))
-	if subnetMask == nil {
-		subnetMask = net.IPMask(net.ParseIP(n.BindMask))
-		if subnetMask == nil {
-			subnetMask = n.ipnet.Mask
-		}
+// GetNextIp6 returns the next free address in the Network's IpRange6.
+func (n *Network) GetNextIp6() (string, error) {
+	if err := n.initPools(); err != nil {
+		return "", err
 	}
-	out := net.IPNet{
-		IP:   net.IPv4(b[0], b[1], b[2], b[3]),
-		Mask: subnetMask,
+	if n.pool6 == nil {
+		return "", fmt.Errorf("network %s has no IPv6 range", n.Name)
 	}
-	return out.String(), nil
+
+	ip, err := n.pool6.allocate("GetNextIp6")
+	if err != nil {
+		return "", fmt.Errorf("network %s: %s", n.Name, err)
+	}
+	return n.pool6.format(ip, "", ""), nil
+}
+
+// GetNextIps returns the next free address in each of the Network's ranges, so
+// a dual-stack network yields one IPv4 and one IPv6 address.
+func (n *Network) GetNextIps(mask string) ([]string, error) {
+	return n.assign("GetNextIps", "", mask)
 }
 
 // Peer describes a peer to be rendered into a network namespace.
@@ -415,6 +668,9 @@ type Peer struct {
 	Links map[string]*LinkOpts
 	// The default subnet mask for this peer.
 	BindMask string
+	// Workloads are commands run in the peer's namespace by
+	// RenderedNetwork.RunWorkloads once the network is created.
+	Workloads []Workload
 }
 
 // LinkOpts describes a physical network connection.
@@ -427,6 +683,15 @@ type LinkOpts struct {
 	Bandwidth string
 	// PacketLoss rate of the interface.
 	PacketLoss string
+	// Routed makes a link between two networks a routed hop through a router
+	// namespace instead of joining the networks into one segment. Peers get
+	// routes to every network reachable through routed links. It has no
+	// effect on a peer's links.
+	Routed bool
+	// Address is a static address for a peer's link, instead of the next
+	// free one from the network's range. On dual-stack networks it only
+	// replaces the address of its own family.
+	Address string
 
 	lset *ctrlnet.LinkSettings
 }
@@ -469,11 +734,37 @@ func (lo *LinkOpts) Parse() error {
 	return nil
 }
 
+// empty reports whether lo configures none of the physical qualities of a
+// link. A nil LinkOpts is empty.
+func (lo *LinkOpts) empty() bool {
+	return lo == nil || lo.Bandwidth == "" && lo.PacketLoss == "" && lo.Jitter == "" && lo.Latency == ""
+}
+
+// String describes the physical qualities set in lo, e.g.
+// "latency 50ms loss 1%".
+func (lo *LinkOpts) String() string {
+	if lo == nil {
+		return ""
+	}
+	var parts []string
+	for _, o := range [][2]string{
+		{"latency", lo.Latency},
+		{"jitter", lo.Jitter},
+		{"bandwidth", lo.Bandwidth},
+		{"loss", lo.PacketLoss},
+	} {
+		if o[1] != "" {
+			parts = append(parts, o[0]+" "+o[1])
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
 // Apply configures an interface to have the specified settings. It is all or
 // nothing, so a user must configure all aspects of the LinkOpts for this method
 // to have an effect.
 func (lo *LinkOpts) Apply(iface string) error {
-	if lo.Bandwidth == "" && lo.PacketLoss == "" && lo.Jitter == "" && lo.Latency == "" {
+	if lo.empty() {
 		return nil
 	}
 
@@ -484,167 +775,245 @@ func (lo *LinkOpts) Apply(iface string) error {
 	return ctrlnet.SetLink(iface, lo.lset)
 }
 
+// applyLink configures an interface to have the settings in l through the
+// RenderedNetwork's Runner. Like LinkOpts.Apply, it does nothing unless some
+// option is set.
+func (r *RenderedNetwork) applyLink(iface string, l *LinkOpts) error {
+	if l.empty() {
+		return nil
+	}
+
+	if l.lset == nil {
+		return fmt.Errorf("linkopts has not been parsed for iface %s", iface)
+	}
+
+	if ls, ok := r.runner().(LinkSetter); ok {
+		return ls.SetLink(iface, l.lset)
+	}
+	return r.run(netemArgs(iface, l.lset)...)
+}
+
 // Create realizes a Config as a RenderedNetwork, tracking the side effects in
 // the RenderedNetwork.
 func (cfg *Config) Create() (*RenderedNetwork, error) {
-	nets := make(map[string]*Network)
-	for i := range cfg.Networks {
-		n := cfg.Networks[i]
-		if _, ok := nets[n.Name]; ok {
-			return nil, fmt.Errorf("duplicate network name: %s", n.Name)
-		}
+	r := cfg.NewRenderedNetwork()
+	return r, cfg.Render(r)
+}
 
-		_, ipn, err := net.ParseCIDR(n.IpRange)
-		if err != nil {
-			return nil, err
-		}
+// Render realizes a Config into r, which must have been created by
+// NewRenderedNetwork. It allows the caller to configure r (e.g. its Runner)
+// before anything is created.
+//
+// Render is all or nothing: on failure, everything it created is deleted
+// again, newest first, unless r.KeepPartial is set. Either way r holds
+// whatever is left on the host.
+//
+// Render holds the lock at LockPath throughout, so that netdef processes
+// rendering at the same time do not pick the same names.
+func (cfg *Config) Render(r *RenderedNetwork) error {
+	if r.Created.IsZero() {
+		r.Created = time.Now()
+	}
+	unlock, err := r.lockHost()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-		n.ipnet = ipn
-		nets[n.Name] = &n
+	if err := r.journalBegin(); err != nil {
+		return err
 	}
+	start := len(r.resources)
+	err = cfg.render(r)
+	if err == nil || r.KeepPartial {
+		return err
+	}
+	if rerr := r.rollback(start); rerr != nil {
+		return fmt.Errorf("%s (rolling back: %s)", err, rerr)
+	}
+	return err
+}
 
-	peers := make(map[string]bool)
-	for _, p := range cfg.Peers {
-		_, ok := peers[p.Name]
-		if ok {
-			return nil, fmt.Errorf("duplicate peer name: %s", p.Name)
-		}
-		peers[p.Name] = true
+func (cfg *Config) render(r *RenderedNetwork) error {
+	p, err := cfg.validate()
+	if err != nil {
+		return err
+	}
+	if err := r.checkNaming(cfg); err != nil {
+		return err
+	}
 
-		for net, l := range p.Links {
-			if _, ok := nets[net]; !ok {
-				return nil, fmt.Errorf("peer %s has link to non-existent network %q", p.Name, net)
-			}
+	// Assign every address before touching the host, so that conflicts and
+	// exhausted ranges are reported without leaving anything behind.
+	if err := p.assignAddrs(); err != nil {
+		return err
+	}
 
-			if l == nil {
-				continue
-			}
-			if err := l.Parse(); err != nil {
-				return nil, err
-			}
+	// Everything is created in a fixed order, the same as Apply's, so that
+	// a config gets the same names and addresses on every clean host and
+	// Create does what Plan says it would.
+	for _, n := range sortedKeys(p.nets) {
+		if err := r.createNetwork(n, p.bridgeType(n)); err != nil {
+			return err
 		}
 	}
 
-	for name, net := range nets {
-		for targetNet, l := range net.Links {
-			if _, ok := nets[targetNet]; !ok {
-				return nil, fmt.Errorf("network %s has link to non-existent network %s", name, targetNet)
-			}
-
-			if l == nil {
-				continue
-			}
-			if err := l.Parse(); err != nil {
-				return nil, err
-			}
+	patches := p.patches()
+	for _, name := range sortedKeys(patches) {
+		pt := patches[name]
+		if err := r.createPatch(pt.a, pt.b, pt.opts); err != nil {
+			return err
 		}
 	}
 
-	r := cfg.NewRenderedNetwork()
+	if err := r.createRouters(p.routers, p.routerAddrs); err != nil {
+		return err
+	}
 
-	for n := range nets {
-		bridgename, err := r.freshNetworkName(n)
-		if err != nil {
-			return r, errors.Wrap(err, "generating network name")
-		}
-		if err := r.CreateBridge(bridgename); err != nil {
-			return r, errors.Wrap(err, "creating bridge")
-		}
+	if err := r.createNats(p.nats); err != nil {
+		return err
 	}
 
-	for name, net := range nets {
-		bridge := r.subnets[name]
-		for targetNet, l := range net.Links {
-			targetBridge := r.subnets[targetNet]
-			if err := r.PatchBridges(bridge, targetBridge, l); err != nil {
-				return r, errors.Wrap(err, "patching bridges")
-			}
+	for _, peer := range cfg.Peers {
+		if err := r.createPeer(peer, p.addrs[peer.Name]); err != nil {
+			return err
 		}
 	}
 
-	for _, p := range cfg.Peers {
-		if err := r.CreateNamespace(p.Name); err != nil {
-			return r, err
-		}
-		ns := r.Namespaces[p.Name]
+	if err := r.addRoutes(p.routes(r)); err != nil {
+		return errors.Wrap(err, "routing")
+	}
 
-		for net, l := range p.Links {
-			bridge := r.subnets[net]
-			lnA, err := r.freshVethName("Interface")
-			if err != nil {
-				return r, errors.Wrap(err, "generate interface name")
-			}
-			lnB, err := r.freshVethName("Port")
-			if err != nil {
-				return r, errors.Wrap(err, "generate port name")
-			}
+	r.Config = cfg.clone()
+	return nil
+}
 
-			if err := r.CreateVethPair(lnA, lnB); err != nil {
-				return r, errors.Wrap(err, "create veth pair")
-			}
+// clone returns a deep copy of cfg, so that a RenderedNetwork's record of its
+// Config is not changed by later edits to the original.
+func (cfg *Config) clone() *Config {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		panic(err)
+	}
+	out := new(Config)
+	if err := json.Unmarshal(b, out); err != nil {
+		panic(err)
+	}
+	return out
+}
 
-			if err := r.BridgeAddPort(bridge, lnB); err != nil {
-				return r, errors.Wrap(err, "bridge add port")
-			}
+// createNetwork creates a bridge of type typ for a network.
+func (r *RenderedNetwork) createNetwork(name, typ string) error {
+	bridgename, err := r.freshNetworkName(name)
+	if err != nil {
+		return errors.Wrap(err, "generating network name")
+	}
+	if err := r.CreateBridgeOfType(bridgename, typ); err != nil {
+		return errors.Wrap(err, "creating bridge")
+	}
+	return nil
+}
 
-			if err := r.AssignVethToNamespace(lnA, ns); err != nil {
-				return r, errors.Wrap(err, "failed to assign veth to namespace")
-			}
+// createPatch patches the bridges of two networks together and records the
+// patch under "a:b".
+func (r *RenderedNetwork) createPatch(a, b string, l *LinkOpts) error {
+	pt, err := r.patchBridges(r.Networks[a], r.Networks[b], l)
+	if err != nil {
+		return errors.Wrap(err, "patching bridges")
+	}
+	if r.Patches == nil {
+		r.Patches = make(map[string]*Patch)
+	}
+	r.Patches[a+":"+b] = pt
+	return nil
+}
 
-			if err := r.NetNsExec(ns, "ip", "link", "set", "dev", "lo", "up"); err != nil {
-				return r, errors.Wrap(err, "set ns link up")
-			}
+// createPeer creates the namespace of a peer and connects it to each of its
+// networks with the given addresses.
+func (r *RenderedNetwork) createPeer(peer Peer, addrs map[string][]string) error {
+	if err := r.CreateNamespace(peer.Name); err != nil {
+		return err
+	}
 
-			if err := r.NetNsExec(ns, "ip", "link", "set", "dev", lnA, "up"); err != nil {
-				return r, errors.Wrap(err, "set ns link up")
-			}
+	for _, net := range sortedKeys(peer.Links) {
+		if err := r.createPeerLink(peer.Name, net, addrs[net], peer.Links[net]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			if err := r.SetDev(lnB, "up"); err != nil {
-				return r, err
-			}
+// createPeerLink connects an existing peer to a network.
+func (r *RenderedNetwork) createPeerLink(peer, network string, addrs []string, l *LinkOpts) error {
+	pl, err := r.attach("peer "+peer+" on "+network, r.Namespaces[peer], r.Networks[network], addrs, l)
+	if err != nil {
+		return err
+	}
+	r.recordPeerLink(peer, network, pl)
+	return nil
+}
 
-			next, err := nets[net].GetNextIp(p.BindMask)
-			if err != nil {
-				return r, err
-			}
+// attach connects a namespace to a bridge with a veth pair, assigns addrs to
+// the namespace end and applies l to the bridge end. The veths are named for
+// the link described by owner.
+func (r *RenderedNetwork) attach(owner, ns, bridge string, addrs []string, l *LinkOpts) (*PeerLink, error) {
+	lnA, err := r.freshVethName("Interface", owner+" interface")
+	if err != nil {
+		return nil, errors.Wrap(err, "generate interface name")
+	}
+	lnB, err := r.freshVethName("Port", owner+" port")
+	if err != nil {
+		return nil, errors.Wrap(err, "generate port name")
+	}
 
-			if err := r.NetNsExec(ns, "ip", "addr", "add", next, "dev", lnA); err != nil {
-				return r, err
-			}
+	if err := r.CreateVethPair(lnA, lnB); err != nil {
+		return nil, errors.Wrap(err, "create veth pair")
+	}
 
-			if l == nil {
-				continue
-			}
-			if err := l.Apply(lnB); err != nil {
-				return r, err
-			}
-		}
+	mac := linkMAC(ns, lnA)
+	if err := r.SetDevMAC(lnA, mac); err != nil {
+		return nil, errors.Wrap(err, "set interface address")
 	}
 
-	return r, nil
-}
+	if err := r.BridgeAddPort(bridge, lnB); err != nil {
+		return nil, errors.Wrap(err, "bridge add port")
+	}
 
-// Cleanup reverses the changes made by calling Create on a Config.
-func (r *RenderedNetwork) Cleanup() error {
-	for iface := range r.Interfaces {
-		if err := r.DeleteInterface(iface); err != nil {
-			return err
-		}
+	if err := r.AssignVethToNamespace(lnA, ns); err != nil {
+		return nil, errors.Wrap(err, "failed to assign veth to namespace")
 	}
 
-	for _, ns := range r.Namespaces {
-		if err := r.DeleteNamespace(ns); err != nil {
-			return err
-		}
+	if err := r.SetNsDev(ns, "lo", "up"); err != nil {
+		return nil, errors.Wrap(err, "set ns link up")
 	}
 
-	for br := range r.Bridges {
-		if err := r.DeleteBridge(br); err != nil {
-			return err
+	if err := r.SetNsDev(ns, lnA, "up"); err != nil {
+		return nil, errors.Wrap(err, "set ns link up")
+	}
+
+	if err := r.SetDev(lnB, "up"); err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if err := r.AddNsAddr(ns, lnA, addr); err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
+	if err := r.applyLink(lnB, l); err != nil {
+		return nil, err
+	}
+
+	return &PeerLink{
+		Namespace: ns,
+		Interface: lnA,
+		Port:      lnB,
+		Bridge:    bridge,
+		MAC:       mac,
+		Addrs:     addrs,
+		Link:      l,
+	}, nil
 }
 
 /*
@@ -0,0 +1,391 @@
+package netdef
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// LinkError records a failed netlink operation and the object it acted on.
+type LinkError struct {
+	// Op is the operation that failed, e.g. "add veth".
+	Op string
+	// Name is the interface, namespace or address being operated on.
+	Name string
+	// Err is the underlying error, typically a syscall.Errno.
+	Err error
+}
+
+func (e *LinkError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Op, e.Name, e.Err)
+}
+
+// Cause returns the underlying error.
+func (e *LinkError) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the underlying error.
+func (e *LinkError) Unwrap() error {
+	return e.Err
+}
+
+// NetlinkBackend implements Backend by talking rtnetlink directly and
+// switching namespaces with setns, without spawning any processes.
+type NetlinkBackend struct{}
+
+// AddNamespace creates a namespace bind-mounted under /var/run/netns, like
+// `ip netns add`.
+func (NetlinkBackend) AddNamespace(name string) error {
+	// NewNamed moves the calling thread into a new namespace, even if it
+	// then fails to name it.
+	return onNetnsThread(func() error {
+		ns, err := netns.NewNamed(name)
+		if err != nil {
+			return &LinkError{"add namespace", name, err}
+		}
+		ns.Close()
+		return nil
+	})
+}
+
+// DeleteNamespace removes a namespace created by AddNamespace.
+func (NetlinkBackend) DeleteNamespace(name string) error {
+	if err := netns.DeleteNamed(name); err != nil {
+		return &LinkError{"delete namespace", name, err}
+	}
+	return nil
+}
+
+// AddVeth creates a veth interface. Its peer is named like the kernel would
+// name it.
+func (b NetlinkBackend) AddVeth(name string) error {
+	names, err := b.VethNames()
+	if err != nil {
+		return err
+	}
+	return b.AddVethPair(name, freshName("veth", append(names, name)))
+}
+
+// AddVethPair creates a pair of connected veth interfaces.
+func (NetlinkBackend) AddVethPair(a, b string) error {
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: a},
+		PeerName:  b,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return &LinkError{"add veth", a, err}
+	}
+	return nil
+}
+
+// DeleteLink deletes an interface in the global namespace.
+func (NetlinkBackend) DeleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return &LinkError{"find link", name, err}
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return &LinkError{"delete link", name, err}
+	}
+	return nil
+}
+
+// SetLinkNamespace moves an interface into a named namespace.
+func (NetlinkBackend) SetLinkNamespace(link, ns string) error {
+	l, err := netlink.LinkByName(link)
+	if err != nil {
+		return &LinkError{"find link", link, err}
+	}
+
+	nsh, err := netns.GetFromName(ns)
+	if err != nil {
+		return &LinkError{"open namespace", ns, err}
+	}
+	defer nsh.Close()
+
+	if err := netlink.LinkSetNsFd(l, int(nsh)); err != nil {
+		return &LinkError{"move link to " + ns, link, err}
+	}
+	return nil
+}
+
+// SetLinkState sets an interface "up" or "down".
+func (NetlinkBackend) SetLinkState(ns, link, state string) error {
+	h, err := handleAt(ns)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	l, err := h.LinkByName(link)
+	if err != nil {
+		return &LinkError{"find link", link, err}
+	}
+
+	switch state {
+	case "up":
+		err = h.LinkSetUp(l)
+	case "down":
+		err = h.LinkSetDown(l)
+	default:
+		return fmt.Errorf("unknown link state %q", state)
+	}
+	if err != nil {
+		return &LinkError{"set link " + state, link, err}
+	}
+	return nil
+}
+
+// SetLinkMAC sets the hardware address of an interface.
+func (NetlinkBackend) SetLinkMAC(link, mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return &LinkError{"parse address", mac, err}
+	}
+
+	l, err := netlink.LinkByName(link)
+	if err != nil {
+		return &LinkError{"find link", link, err}
+	}
+	if err := netlink.LinkSetHardwareAddr(l, hw); err != nil {
+		return &LinkError{"set address " + mac, link, err}
+	}
+	return nil
+}
+
+// AddAddr assigns an address to an interface within a namespace.
+func (NetlinkBackend) AddAddr(ns, link, cidr string) error {
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		return &LinkError{"parse address", cidr, err}
+	}
+	if addr.IP.To4() == nil {
+		// Skip duplicate address detection so the address is usable
+		// immediately, as the ip backend does.
+		addr.Flags |= unix.IFA_F_NODAD
+	}
+
+	h, err := handleAt(ns)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	l, err := h.LinkByName(link)
+	if err != nil {
+		return &LinkError{"find link", link, err}
+	}
+	if err := h.AddrAdd(l, addr); err != nil {
+		return &LinkError{"add address " + cidr, link, err}
+	}
+	return nil
+}
+
+// AddRoute adds a route through a gateway within a namespace.
+func (NetlinkBackend) AddRoute(ns, dst, via string) error {
+	return gatewayRoute(ns, dst, via, true)
+}
+
+// DeleteRoute removes a route added by AddRoute.
+func (NetlinkBackend) DeleteRoute(ns, dst, via string) error {
+	return gatewayRoute(ns, dst, via, false)
+}
+
+func gatewayRoute(ns, dst, via string, add bool) error {
+	_, dstnet, err := net.ParseCIDR(dst)
+	if err != nil {
+		return &LinkError{"parse route", dst, err}
+	}
+	gw := net.ParseIP(via)
+	if gw == nil {
+		return &LinkError{"parse gateway", via, fmt.Errorf("invalid address")}
+	}
+
+	h, err := handleAt(ns)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	rt := &netlink.Route{Dst: dstnet, Gw: gw}
+	if add {
+		err = h.RouteAdd(rt)
+	} else {
+		err = h.RouteDel(rt)
+	}
+	if err != nil {
+		op := "add route via "
+		if !add {
+			op = "delete route via "
+		}
+		return &LinkError{op + via, dst, err}
+	}
+	return nil
+}
+
+// AddBlackhole adds a blackhole route within a namespace.
+func (NetlinkBackend) AddBlackhole(ns, dst string) error {
+	return blackholeRoute(ns, dst, true)
+}
+
+// DeleteBlackhole removes a blackhole route within a namespace.
+func (NetlinkBackend) DeleteBlackhole(ns, dst string) error {
+	return blackholeRoute(ns, dst, false)
+}
+
+func blackholeRoute(ns, dst string, add bool) error {
+	_, dstnet, err := net.ParseCIDR(dst)
+	if err != nil {
+		return &LinkError{"parse route", dst, err}
+	}
+
+	h, err := handleAt(ns)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	rt := &netlink.Route{Dst: dstnet, Type: unix.RTN_BLACKHOLE}
+	if add {
+		err = h.RouteAdd(rt)
+	} else {
+		err = h.RouteDel(rt)
+	}
+	if err != nil {
+		op := "add blackhole"
+		if !add {
+			op = "delete blackhole"
+		}
+		return &LinkError{op, dst, err}
+	}
+	return nil
+}
+
+// SetSysctl writes a sysctl under /proc/sys from within a namespace.
+func (NetlinkBackend) SetSysctl(ns, key, val string) error {
+	path := "/proc/sys/" + strings.Replace(key, ".", "/", -1)
+	err := inNetns(ns, func() error {
+		return ioutil.WriteFile(path, []byte(val), 0644)
+	})
+	if err != nil {
+		return &LinkError{"set sysctl " + key, ns, err}
+	}
+	return nil
+}
+
+// inNetns runs f on a thread switched into a named namespace.
+func inNetns(ns string, f func() error) error {
+	target, err := netns.GetFromName(ns)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	return onNetnsThread(func() error {
+		if err := netns.Set(target); err != nil {
+			return err
+		}
+		return f()
+	})
+}
+
+// onNetnsThread runs f in a new goroutine locked to its OS thread, which may
+// switch namespaces, and then moves the thread back to its own namespace
+// whether f failed or not. If that fails, the goroutine exits without
+// unlocking the thread, so that the runtime does not reuse it.
+func onNetnsThread(f func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		orig, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- &LinkError{"get namespace", "current", err}
+			return
+		}
+		defer orig.Close()
+
+		ferr := f()
+		if err := netns.Set(orig); err != nil {
+			errc <- &LinkError{"restore namespace", "current", err}
+			return
+		}
+		runtime.UnlockOSThread()
+		errc <- ferr
+	}()
+	return <-errc
+}
+
+// VethNames lists the veth interfaces in the global namespace.
+func (NetlinkBackend) VethNames() ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, &LinkError{"list links", "veth", err}
+	}
+	ret := make([]string, 0)
+	for _, l := range links {
+		if l.Type() == "veth" {
+			ret = append(ret, l.Attrs().Name)
+		}
+	}
+	return ret, nil
+}
+
+// SetLinkAlias sets the alias of an interface.
+func (NetlinkBackend) SetLinkAlias(link, alias string) error {
+	l, err := netlink.LinkByName(link)
+	if err != nil {
+		return &LinkError{"find link", link, err}
+	}
+	if err := netlink.LinkSetAlias(l, alias); err != nil {
+		return &LinkError{"set alias", link, err}
+	}
+	return nil
+}
+
+// LinkAliases maps the interfaces that have an alias to it.
+func (NetlinkBackend) LinkAliases() (map[string]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, &LinkError{"list links", "all", err}
+	}
+	ret := make(map[string]string)
+	for _, l := range links {
+		if a := l.Attrs().Alias; a != "" {
+			ret[l.Attrs().Name] = a
+		}
+	}
+	return ret, nil
+}
+
+// handleAt returns a netlink handle for a named namespace, or for the global
+// namespace if ns is empty.
+func handleAt(ns string) (*netlink.Handle, error) {
+	if ns == "" {
+		h, err := netlink.NewHandle()
+		if err != nil {
+			return nil, &LinkError{"open netlink", "global namespace", err}
+		}
+		return h, nil
+	}
+
+	nsh, err := netns.GetFromName(ns)
+	if err != nil {
+		return nil, &LinkError{"open namespace", ns, err}
+	}
+	defer nsh.Close()
+
+	h, err := netlink.NewHandleAt(nsh)
+	if err != nil {
+		return nil, &LinkError{"open netlink in", ns, err}
+	}
+	return h, nil
+}
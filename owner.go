@@ -0,0 +1,105 @@
+package netdef
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MarkerDir holds a marker for every namespace netdef creates. Each marker is
+// a symlink named after the namespace that points at its owner tag, so that
+// it is written and read atomically.
+var MarkerDir = "/run/netdef/netns"
+
+// ovsOwnerKey is the external_ids key holding the owner tag of openvswitch
+// bridges and ports.
+const ovsOwnerKey = "netdef-owner"
+
+// newID returns a random ID for a RenderedNetwork.
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ownerTag returns the tag put on resources r creates now. It has the form
+// "netdef:<id>:<unix time>".
+func (r *RenderedNetwork) ownerTag() string {
+	return fmt.Sprintf("netdef:%s:%d", r.ID, time.Now().Unix())
+}
+
+// parseOwnerTag splits a tag made by ownerTag into the owner ID and creation
+// time. ok is false if s is not such a tag.
+func parseOwnerTag(s string) (id string, created time.Time, ok bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 || parts[0] != "netdef" || parts[1] == "" {
+		return "", time.Time{}, false
+	}
+	secs, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return parts[1], time.Unix(secs, 0), true
+}
+
+// tagLink sets the alias of an interface in the global namespace to r's owner
+// tag. Nothing is tagged if r has no ID.
+func (r *RenderedNetwork) tagLink(name string) error {
+	if r.ID == "" {
+		return nil
+	}
+	return r.backend().SetLinkAlias(name, r.ownerTag())
+}
+
+// tagOVS records r's owner tag in the external_ids of an openvswitch bridge
+// or port, selected by table.
+func (r *RenderedNetwork) tagOVS(table, name string) error {
+	if r.ID == "" {
+		return nil
+	}
+	return r.run("ovs-vsctl", "set", table, name, fmt.Sprintf("external_ids:%s=%s", ovsOwnerKey, r.ownerTag()))
+}
+
+// markNamespace writes the marker of a namespace. Markers are written directly
+// rather than through the Runner, and not at all when r does not change the
+// host.
+func (r *RenderedNetwork) markNamespace(ns string) error {
+	if r.ID == "" || !r.changesHost() {
+		return nil
+	}
+	if err := os.MkdirAll(MarkerDir, 0755); err != nil {
+		return err
+	}
+	// Replace any marker left behind by an earlier namespace of that name.
+	if err := removeMarker(ns); err != nil {
+		return err
+	}
+	return os.Symlink(r.ownerTag(), filepath.Join(MarkerDir, ns))
+}
+
+// unmarkNamespace removes the marker of a namespace, if there is one.
+func (r *RenderedNetwork) unmarkNamespace(ns string) error {
+	if !r.changesHost() {
+		return nil
+	}
+	return removeMarker(ns)
+}
+
+// removeMarker removes the marker of a namespace, if there is one.
+func removeMarker(ns string) error {
+	err := os.Remove(filepath.Join(MarkerDir, ns))
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package netdef
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseOwnerTag(t *testing.T) {
+	cases := []struct {
+		tag     string
+		id      string
+		created int64
+		ok      bool
+	}{
+		{"netdef:abc123:1700000000", "abc123", 1700000000, true},
+		{"netdef::1700000000", "", 0, false},
+		{"netdef:abc123", "", 0, false},
+		{"netdef:abc123:soon", "", 0, false},
+		{"other:abc123:1700000000", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, c := range cases {
+		id, created, ok := parseOwnerTag(c.tag)
+		if ok != c.ok || id != c.id || ok && !created.Equal(time.Unix(c.created, 0)) {
+			t.Errorf("%q: got %q, %v, %v", c.tag, id, created, ok)
+		}
+	}
+
+	r := &RenderedNetwork{ID: newID()}
+	if id, _, ok := parseOwnerTag(r.ownerTag()); !ok || id != r.ID {
+		t.Errorf("tag %q does not parse back to ID %s", r.ownerTag(), r.ID)
+	}
+}
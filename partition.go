@@ -0,0 +1,129 @@
+package netdef
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Partition splits the peers into groups that cannot reach each other. Peers
+// in the same group, and peers not in any group, are unaffected. It is
+// implemented with blackhole routes in each peer's namespace to the addresses
+// of the peers in other groups, so it applies across bridges and routers but
+// cannot tell apart peers sharing an address behind a NAT.
+//
+// Any existing partition is healed first. The groups are recorded in
+// Partitions so that Heal works on a RenderedNetwork loaded from disk. If a
+// route cannot be added, the routes added so far are removed again; the groups
+// stay recorded only if that fails too, so that Heal can finish the job.
+func (r *RenderedNetwork) Partition(groups ...[]string) error {
+	seen := make(map[string]bool)
+	for _, g := range groups {
+		for _, p := range g {
+			if _, ok := r.Namespaces[p]; !ok {
+				return fmt.Errorf("no such peer: %s", p)
+			}
+			if seen[p] {
+				return fmt.Errorf("peer %s is in more than one group", p)
+			}
+			seen[p] = true
+		}
+	}
+
+	if err := r.Heal(); err != nil {
+		return err
+	}
+
+	r.Partitions = groups
+	bhs := r.blackholes()
+	for i, bh := range bhs {
+		if err := r.backend().AddBlackhole(r.Namespaces[bh.peer], bh.dst); err != nil {
+			err = errors.Wrapf(err, "partitioning %s", bh.peer)
+			if uerr := r.deleteBlackholes(bhs[:i]); uerr != nil {
+				return fmt.Errorf("%s (undoing: %s)", err, uerr)
+			}
+			r.Partitions = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// Heal removes the partition made by Partition, if any. Routes that are
+// already gone count as removed.
+func (r *RenderedNetwork) Heal() error {
+	if err := r.deleteBlackholes(r.blackholes()); err != nil {
+		return err
+	}
+	r.Partitions = nil
+	return nil
+}
+
+// deleteBlackholes removes blackhole routes, newest first.
+func (r *RenderedNetwork) deleteBlackholes(bhs []blackhole) error {
+	for i := len(bhs) - 1; i >= 0; i-- {
+		bh := bhs[i]
+		err := r.backend().DeleteBlackhole(r.Namespaces[bh.peer], bh.dst)
+		if err != nil && !isGone(err) {
+			return errors.Wrapf(err, "healing %s", bh.peer)
+		}
+	}
+	return nil
+}
+
+// blackhole is a route that drops traffic from a peer to dst.
+type blackhole struct {
+	peer string
+	dst  string
+}
+
+// blackholes returns the routes that realize the recorded partition, in a
+// stable order.
+func (r *RenderedNetwork) blackholes() []blackhole {
+	group := make(map[string]int)
+	for i, g := range r.Partitions {
+		for _, p := range g {
+			group[p] = i
+		}
+	}
+
+	var out []blackhole
+	for from, gf := range group {
+		for to, gt := range group {
+			if gf == gt {
+				continue
+			}
+			for _, dst := range r.hostRoutes(to) {
+				out = append(out, blackhole{from, dst})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].peer != out[j].peer {
+			return out[i].peer < out[j].peer
+		}
+		return out[i].dst < out[j].dst
+	})
+	return out
+}
+
+// hostRoutes returns a host route to each address of a peer.
+func (r *RenderedNetwork) hostRoutes(peer string) []string {
+	var out []string
+	for _, pl := range r.PeerLinks[peer] {
+		for _, a := range pl.Addrs {
+			ip, _, err := net.ParseCIDR(a)
+			if err != nil {
+				continue
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			out = append(out, (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String())
+		}
+	}
+	return out
+}
@@ -0,0 +1,91 @@
+package netdef
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func partitionNetwork(t *testing.T) *RenderedNetwork {
+	cfg := testConfig()
+	cfg.Networks = []Network{{Name: "lan", IpRange: "10.0.0.0/24"}}
+	cfg.Peers = []Peer{
+		{Name: "a", Links: map[string]*LinkOpts{"lan": nil}},
+		{Name: "b", Links: map[string]*LinkOpts{"lan": nil}},
+		{Name: "c", Links: map[string]*LinkOpts{"lan": nil}},
+	}
+	r, _ := renderFake(t, cfg)
+	return r
+}
+
+func TestPartition(t *testing.T) {
+	r := partitionNetwork(t)
+	f := &fakeRunner{}
+	r.Runner = f
+
+	if err := r.Partition([]string{"a"}, []string{"b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ip netns exec tns0 ip route add blackhole 10.0.0.2/32",
+		"ip netns exec tns0 ip route add blackhole 10.0.0.3/32",
+		"ip netns exec tns1 ip route add blackhole 10.0.0.1/32",
+		"ip netns exec tns2 ip route add blackhole 10.0.0.1/32",
+	}
+	if strings.Join(f.cmds, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got commands\n%s\nwant\n%s", strings.Join(f.cmds, "\n"), strings.Join(want, "\n"))
+	}
+
+	cases := []struct {
+		groups [][]string
+		err    string
+	}{
+		{[][]string{{"a"}, {"x"}}, "no such peer: x"},
+		{[][]string{{"a", "b"}, {"b"}}, "more than one group"},
+	}
+	for _, c := range cases {
+		if err := r.Partition(c.groups...); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: got error %v, want one containing %q", c.groups, err, c.err)
+		}
+	}
+}
+
+func TestPartitionFailure(t *testing.T) {
+	r := partitionNetwork(t)
+	f := &fakeRunner{fail: map[string]error{
+		"ip netns exec tns1 ip route add": errors.New("RTNETLINK answers: File exists"),
+	}}
+	r.Runner = f
+
+	if err := r.Partition([]string{"a"}, []string{"b", "c"}); err == nil {
+		t.Fatal("partition succeeded")
+	}
+	if r.Partitions != nil {
+		t.Errorf("failed partition recorded as %v", r.Partitions)
+	}
+	want := []string{
+		"ip netns exec tns0 ip route del blackhole 10.0.0.3/32",
+		"ip netns exec tns0 ip route del blackhole 10.0.0.2/32",
+	}
+	if got := f.grep("route del"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got undo commands\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestHealMissingRoutes(t *testing.T) {
+	r := partitionNetwork(t)
+	r.Runner = &fakeRunner{}
+	if err := r.Partition([]string{"a"}, []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Runner = &fakeRunner{fail: map[string]error{
+		"ip netns exec tns0": errors.New("RTNETLINK answers: No such process"),
+	}}
+	if err := r.Heal(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Partitions != nil {
+		t.Errorf("healed partition still recorded as %v", r.Partitions)
+	}
+}
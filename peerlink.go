@@ -0,0 +1,147 @@
+package netdef
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PeerLink records how a peer was connected to a network.
+type PeerLink struct {
+	// Namespace is the peer's namespace.
+	Namespace string
+	// Interface is the veth inside the namespace.
+	Interface string
+	// Port is the other end of the veth, attached to the bridge in the
+	// global namespace.
+	Port string
+	// Bridge is the bridge of the network.
+	Bridge string
+	// MAC is the hardware address of Interface.
+	MAC string
+	// Addrs are the addresses assigned to Interface in CIDR notation, one per
+	// address family of the network.
+	Addrs []string
+	// Link holds the link options currently applied to Port, if any.
+	Link *LinkOpts
+	// Down is set while the link has been taken down with SetLinkState.
+	Down bool
+}
+
+// PeerLink returns the record of a peer's link to a network.
+func (r *RenderedNetwork) PeerLink(peer, network string) (*PeerLink, error) {
+	links, ok := r.PeerLinks[peer]
+	if !ok {
+		return nil, fmt.Errorf("no such peer: %s", peer)
+	}
+	pl, ok := links[network]
+	if !ok {
+		return nil, fmt.Errorf("peer %s has no link to network %s", peer, network)
+	}
+	return pl, nil
+}
+
+// PeerAddrs returns the addresses of a peer on a network.
+func (r *RenderedNetwork) PeerAddrs(peer, network string) ([]net.IP, error) {
+	pl, err := r.PeerLink(peer, network)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(pl.Addrs))
+	for _, a := range pl.Addrs {
+		ip, _, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// PeerAddr returns the address of a peer on a network. On dual-stack networks
+// it returns the IPv4 address.
+func (r *RenderedNetwork) PeerAddr(peer, network string) (net.IP, error) {
+	ips, err := r.PeerAddrs(peer, network)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("peer %s has no address on network %s", peer, network)
+	}
+	return ips[0], nil
+}
+
+// UpdateLink replaces the link options of a peer's link to a network. The
+// options are applied to the existing port, so addresses and processes in the
+// peer's namespace are not disturbed. A nil or empty l removes all options.
+func (r *RenderedNetwork) UpdateLink(peer, network string, l *LinkOpts) error {
+	pl, err := r.PeerLink(peer, network)
+	if err != nil {
+		return err
+	}
+
+	if l != nil {
+		if err := l.Parse(); err != nil {
+			return err
+		}
+	}
+
+	// Not every way of applying options replaces existing ones, so clear
+	// them first.
+	if !pl.Link.empty() {
+		if err := r.clearLink(pl.Port); err != nil {
+			return errors.Wrapf(err, "clearing link of %s to %s", peer, network)
+		}
+	}
+	if err := r.applyLink(pl.Port, l); err != nil {
+		return errors.Wrapf(err, "updating link of %s to %s", peer, network)
+	}
+
+	pl.Link = l
+	return nil
+}
+
+// clearLink removes the options applied to iface. An interface without any,
+// e.g. because they were removed by hand, is fine.
+func (r *RenderedNetwork) clearLink(iface string) error {
+	err := r.run("tc", "qdisc", "del", "dev", iface, "root")
+	// Recent versions of tc report a missing qdisc as a handle of zero,
+	// older ones as ENOENT.
+	if err != nil && (isGone(err) || strings.Contains(err.Error(), "Cannot delete qdisc with handle of zero")) {
+		return nil
+	}
+	return err
+}
+
+// addrs returns the addresses of a link, or nil if pl is nil.
+func (pl *PeerLink) addrs() []string {
+	if pl == nil {
+		return nil
+	}
+	return pl.Addrs
+}
+
+// recordPeerLink stores the record of a peer's link to a network.
+func (r *RenderedNetwork) recordPeerLink(peer, network string, pl *PeerLink) {
+	if r.PeerLinks == nil {
+		r.PeerLinks = make(map[string]map[string]*PeerLink)
+	}
+	if r.PeerLinks[peer] == nil {
+		r.PeerLinks[peer] = make(map[string]*PeerLink)
+	}
+	r.PeerLinks[peer][network] = pl
+}
+
+// linkMAC derives a stable, locally administered unicast MAC address for an
+// interface in a namespace. Namespace names are unique on a host, so the
+// result is too.
+func linkMAC(ns, iface string) string {
+	sum := sha256.Sum256([]byte(ns + "/" + iface))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = mac[0]&0xfe | 0x02
+	return mac.String()
+}
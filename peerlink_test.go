@@ -0,0 +1,88 @@
+package netdef
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func linkNetwork(t *testing.T, opts *LinkOpts) *RenderedNetwork {
+	cfg := testConfig()
+	cfg.Networks = []Network{{Name: "lan", IpRange: "10.0.0.0/24"}}
+	cfg.Peers = []Peer{{Name: "a", Links: map[string]*LinkOpts{"lan": opts}}}
+	r, _ := renderFake(t, cfg)
+	return r
+}
+
+func TestUpdateLink(t *testing.T) {
+	cases := []struct {
+		name string
+		old  *LinkOpts
+		fail map[string]error
+		want []string
+	}{
+		{
+			name: "replaced",
+			old:  &LinkOpts{Latency: "10ms"},
+			want: []string{
+				"tc qdisc del dev ttap0 root",
+				"tc qdisc replace dev ttap0 root netem delay 20ms",
+			},
+		},
+		{
+			name: "without options",
+			old:  nil,
+			want: []string{"tc qdisc replace dev ttap0 root netem delay 20ms"},
+		},
+		{
+			name: "qdisc removed by hand",
+			old:  &LinkOpts{Latency: "10ms"},
+			fail: map[string]error{"tc qdisc del": errors.New("Error: Cannot delete qdisc with handle of zero.")},
+			want: []string{
+				"tc qdisc del dev ttap0 root",
+				"tc qdisc replace dev ttap0 root netem delay 20ms",
+			},
+		},
+		{
+			name: "qdisc removed by hand, older tc",
+			old:  &LinkOpts{Latency: "10ms"},
+			fail: map[string]error{"tc qdisc del": errors.New("RTNETLINK answers: No such file or directory")},
+			want: []string{
+				"tc qdisc del dev ttap0 root",
+				"tc qdisc replace dev ttap0 root netem delay 20ms",
+			},
+		},
+	}
+	for _, c := range cases {
+		r := linkNetwork(t, c.old)
+		f := &fakeRunner{fail: c.fail}
+		r.Runner = f
+
+		if err := r.UpdateLink("a", "lan", &LinkOpts{Latency: "20ms"}); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if strings.Join(f.cmds, "\n") != strings.Join(c.want, "\n") {
+			t.Errorf("%s: got commands\n%s\nwant\n%s", c.name, strings.Join(f.cmds, "\n"), strings.Join(c.want, "\n"))
+		}
+		if pl, _ := r.PeerLink("a", "lan"); pl.Link.Latency != "20ms" {
+			t.Errorf("%s: got recorded latency %q, want 20ms", c.name, pl.Link.Latency)
+		}
+	}
+}
+
+func TestUpdateLinkFailure(t *testing.T) {
+	r := linkNetwork(t, &LinkOpts{Latency: "10ms"})
+	f := &fakeRunner{fail: map[string]error{"tc qdisc del": errors.New("Error: Operation not permitted")}}
+	r.Runner = f
+
+	if err := r.UpdateLink("a", "lan", &LinkOpts{Latency: "20ms"}); err == nil {
+		t.Fatal("update succeeded")
+	}
+	if len(f.cmds) != 1 {
+		t.Errorf("got commands %q after the failure to clear the link", f.cmds)
+	}
+	if pl, _ := r.PeerLink("a", "lan"); pl.Link.Latency != "10ms" {
+		t.Errorf("got recorded latency %q, want 10ms", pl.Link.Latency)
+	}
+}
@@ -0,0 +1,61 @@
+package netdef
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// Plan describes the changes that creating or applying a Config would make,
+// worked out without modifying the host.
+type Plan struct {
+	// Changes are the steps that would be taken, in order.
+	Changes []Change
+	// Commands are the commands that would be run, in order, by a Runner
+	// that is not a LinkSetter and the default IPBackend. Otherwise some of
+	// the changes are made without commands. Owner tags in them carry the
+	// current time, and a fresh ID when creating, so they differ from those
+	// a real run puts on.
+	Commands []string
+	// Render is the RenderedNetwork that would result.
+	Render *RenderedNetwork
+}
+
+// Plan works out what Apply(cfg) would do to r, or what Create would do if r is
+// nil or has not been rendered, in which case only its Name is used. Commands
+// are not run, but the host is queried so that generated names match what
+// would be created right now. r itself is not modified.
+func (cfg *Config) Plan(r *RenderedNetwork) (*Plan, error) {
+	var out bytes.Buffer
+	runner := &DryRunner{Out: &out}
+
+	var pr *RenderedNetwork
+	if r == nil || r.Config == nil {
+		pr = cfg.NewRenderedNetwork()
+		pr.Config = &Config{}
+		if r != nil {
+			pr.Name = r.Name
+		}
+	} else {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		pr = new(RenderedNetwork)
+		if err := json.Unmarshal(b, pr); err != nil {
+			return nil, err
+		}
+	}
+	pr.Runner = runner
+
+	changes, err := pr.Apply(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmds []string
+	if s := strings.TrimSpace(out.String()); s != "" {
+		cmds = strings.Split(s, "\n")
+	}
+	return &Plan{Changes: changes, Commands: cmds, Render: pr}, nil
+}
@@ -0,0 +1,58 @@
+package netdef
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// ownerTagRegexp matches owner tags, which differ between plans and runs.
+var ownerTagRegexp = regexp.MustCompile(`netdef:[0-9a-f]+:[0-9]+`)
+
+func withoutTags(cmds []string) []string {
+	out := make([]string, len(cmds))
+	for i, c := range cmds {
+		out[i] = ownerTagRegexp.ReplaceAllString(c, "netdef:ID:TIME")
+	}
+	return out
+}
+
+func TestPlan(t *testing.T) {
+	// Plans query the host through the ip binary.
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip is not installed")
+	}
+
+	cfg := applyConfig(Peer{Name: "c", Links: map[string]*LinkOpts{"wan": nil}})
+	p, err := cfg.Plan(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, f := renderFake(t, cfg)
+	if got, want := withoutTags(p.Commands), withoutTags(f.cmds); !reflect.DeepEqual(got, want) {
+		t.Errorf("plan commands differ from those of a render:\n%q\n%q", got, want)
+	}
+
+	r, _ := renderFake(t, cfg)
+	before, _ := json.Marshal(r)
+	edited := applyConfig()
+	p, err = edited.Plan(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := json.Marshal(r); !bytes.Equal(after, before) {
+		t.Error("planning modified the render")
+	}
+
+	r.Runner = &fakeRunner{}
+	changes, err := r.Apply(edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.Changes, changes) {
+		t.Errorf("planned changes differ from those applied:\n%v\n%v", p.Changes, changes)
+	}
+}
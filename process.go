@@ -0,0 +1,205 @@
+package netdef
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProcessGrace is how long processes get to exit after being sent SIGTERM,
+// when their namespace is deleted, before they are killed.
+var ProcessGrace = 5 * time.Second
+
+// signalPid sends a signal to a process. Tests replace it.
+var signalPid = syscall.Kill
+
+// ProcessRecord records a process started in a peer's namespace by Start.
+type ProcessRecord struct {
+	Peer      string
+	Namespace string
+	Pid       int
+	// Command is the program and its arguments.
+	Command []string
+}
+
+// Process is a program running in the namespace of a peer, started by Start.
+type Process struct {
+	// Peer is the peer the process runs on.
+	Peer string
+	// Cmd is the running command.
+	Cmd *exec.Cmd
+	// Stdout and Stderr read the output of the process. They must be read,
+	// or the process blocks once it has filled the pipe, and closed once
+	// the process is done with.
+	Stdout *os.File
+	Stderr *os.File
+
+	r *RenderedNetwork
+}
+
+// Start starts a program in the namespace of a peer and records it in
+// Processes until it is waited for. Unlike NetNsExec, it does not wait for the
+// program to exit. It is not run through r's Runner.
+func (r *RenderedNetwork) Start(peer, name string, args ...string) (*Process, error) {
+	cmd, err := r.Command(peer, name, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outR.Close()
+		outW.Close()
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = outW, errW
+	p, err := r.startCmd(peer, append([]string{name}, args...), cmd)
+	// The process has its own copies of the write ends.
+	outW.Close()
+	errW.Close()
+	if err != nil {
+		outR.Close()
+		errR.Close()
+		return nil, err
+	}
+	p.Stdout, p.Stderr = outR, errR
+	return p, nil
+}
+
+// startCmd starts cmd, made by Command to run command on peer, and records it
+// in Processes.
+func (r *RenderedNetwork) startCmd(peer string, command []string, cmd *exec.Cmd) (*Process, error) {
+	ns, err := r.Namespace(peer)
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "starting %s on %s", command[0], peer)
+	}
+
+	r.procLk.Lock()
+	r.Processes = append(r.Processes, &ProcessRecord{
+		Peer:      peer,
+		Namespace: ns,
+		Pid:       cmd.Process.Pid,
+		Command:   command,
+	})
+	r.procLk.Unlock()
+
+	return &Process{Peer: peer, Cmd: cmd, r: r}, nil
+}
+
+// Pid returns the process ID.
+func (p *Process) Pid() int {
+	return p.Cmd.Process.Pid
+}
+
+// Wait waits for the process to exit and drops it from Processes. Like
+// exec.Cmd.Wait, it returns an *exec.ExitError if the process failed.
+func (p *Process) Wait() error {
+	err := p.Cmd.Wait()
+	p.r.forgetProcess(p.Pid())
+	return err
+}
+
+// Signal sends a signal to the process.
+func (p *Process) Signal(sig os.Signal) error {
+	return p.Cmd.Process.Signal(sig)
+}
+
+// Kill kills the process. It must still be waited for.
+func (p *Process) Kill() error {
+	return p.Cmd.Process.Kill()
+}
+
+// forgetProcess drops the record of a process.
+func (r *RenderedNetwork) forgetProcess(pid int) {
+	r.procLk.Lock()
+	defer r.procLk.Unlock()
+	for i, pr := range r.Processes {
+		if pr.Pid == pid {
+			r.Processes = append(r.Processes[:i], r.Processes[i+1:]...)
+			return
+		}
+	}
+}
+
+// forgetProcesses drops the records of the processes in namespace ns.
+func (r *RenderedNetwork) forgetProcesses(ns string) {
+	r.procLk.Lock()
+	defer r.procLk.Unlock()
+	kept := r.Processes[:0]
+	for _, pr := range r.Processes {
+		if pr.Namespace != ns {
+			kept = append(kept, pr)
+		}
+	}
+	r.Processes = kept
+}
+
+// killProcesses terminates every process in namespace ns, whether started by
+// Start or not. Processes get ProcessGrace to exit after SIGTERM before they
+// are sent SIGKILL.
+func (r *RenderedNetwork) killProcesses(ns string) error {
+	pids, err := r.namespacePids(ns)
+	if err != nil || len(pids) == 0 {
+		return err
+	}
+
+	// Signals are sent directly rather than through the Runner, since the
+	// PIDs mean nothing in a recorded or printed transcript.
+	if !r.changesHost() {
+		return nil
+	}
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		for _, pid := range pids {
+			// Processes that are already gone are fine.
+			signalPid(pid, sig)
+		}
+
+		wait := ProcessGrace
+		if sig == syscall.SIGKILL {
+			wait = time.Second
+		}
+		for deadline := time.Now().Add(wait); ; time.Sleep(50 * time.Millisecond) {
+			if pids, err = r.namespacePids(ns); err != nil || len(pids) == 0 {
+				return err
+			}
+			if time.Now().After(deadline) {
+				break
+			}
+		}
+	}
+	return fmt.Errorf("processes %v in namespace %s did not exit", pids, ns)
+}
+
+// namespacePids lists the processes in namespace ns. A namespace that does
+// not exist has none.
+func (r *RenderedNetwork) namespacePids(ns string) ([]int, error) {
+	out, err := r.runner().Output("ip", "netns", "pids", ns)
+	if isGone(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, f := range strings.Fields(string(out)) {
+		pid, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected pid %q from ip netns pids", f)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
@@ -0,0 +1,118 @@
+package netdef
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeProcesses are processes in a namespace that exit on some signals, for
+// testing killProcesses.
+type fakeProcesses struct {
+	lk sync.Mutex
+	// exitOn maps the PIDs of running processes to the signal they exit
+	// on, or 0 if they ignore every signal.
+	exitOn  map[int]syscall.Signal
+	signals []string
+	sent    map[syscall.Signal]time.Time
+}
+
+func (fp *fakeProcesses) signal(pid int, sig syscall.Signal) error {
+	fp.lk.Lock()
+	defer fp.lk.Unlock()
+	fp.signals = append(fp.signals, fmt.Sprintf("%d %s", pid, sig))
+	if _, ok := fp.sent[sig]; !ok {
+		fp.sent[sig] = time.Now()
+	}
+	if fp.exitOn[pid] == sig {
+		delete(fp.exitOn, pid)
+	}
+	return nil
+}
+
+func (fp *fakeProcesses) pids(cmd string) ([]byte, error) {
+	fp.lk.Lock()
+	defer fp.lk.Unlock()
+	var pids []int
+	for pid := range fp.exitOn {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return []byte(strings.Trim(fmt.Sprint(pids), "[]")), nil
+}
+
+func TestKillProcesses(t *testing.T) {
+	defer func(old func(int, syscall.Signal) error) { signalPid = old }(signalPid)
+	defer func(old time.Duration) { ProcessGrace = old }(ProcessGrace)
+	ProcessGrace = 200 * time.Millisecond
+
+	cases := []struct {
+		name    string
+		exitOn  map[int]syscall.Signal
+		signals []string
+		err     string
+	}{
+		{
+			name:   "none",
+			exitOn: map[int]syscall.Signal{},
+		},
+		{
+			name:    "terminated",
+			exitOn:  map[int]syscall.Signal{10: syscall.SIGTERM},
+			signals: []string{"10 terminated"},
+		},
+		{
+			// 11 ignores SIGTERM and is killed after the grace period.
+			name:    "killed",
+			exitOn:  map[int]syscall.Signal{10: syscall.SIGTERM, 11: syscall.SIGKILL},
+			signals: []string{"10 terminated", "11 terminated", "11 killed"},
+		},
+		{
+			name:    "unkillable",
+			exitOn:  map[int]syscall.Signal{12: 0},
+			signals: []string{"12 terminated", "12 killed"},
+			err:     "processes [12] in namespace tns0 did not exit",
+		},
+	}
+	for _, c := range cases {
+		fp := &fakeProcesses{exitOn: c.exitOn, sent: make(map[syscall.Signal]time.Time)}
+		signalPid = fp.signal
+		// Only a netlink backend makes r change the host without going
+		// through its Runner, which is what signals are sent for.
+		r := &RenderedNetwork{Runner: &fakeRunner{out: fp.pids}, Backend: NetlinkBackend{}}
+
+		err := r.killProcesses("tns0")
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: %s", c.name, err)
+		case c.err != "" && (err == nil || err.Error() != c.err):
+			t.Errorf("%s: got error %v, want %q", c.name, err, c.err)
+		}
+
+		if strings.Join(fp.signals, "\n") != strings.Join(c.signals, "\n") {
+			t.Errorf("%s: got signals %q, want %q", c.name, fp.signals, c.signals)
+		}
+		term, kill := fp.sent[syscall.SIGTERM], fp.sent[syscall.SIGKILL]
+		if !kill.IsZero() && kill.Sub(term) < ProcessGrace {
+			t.Errorf("%s: killed %s after SIGTERM, before the grace period of %s", c.name, kill.Sub(term), ProcessGrace)
+		}
+	}
+}
+
+func TestKillProcessesDryRun(t *testing.T) {
+	defer func(old func(int, syscall.Signal) error) { signalPid = old }(signalPid)
+	fp := &fakeProcesses{exitOn: map[int]syscall.Signal{10: syscall.SIGTERM}, sent: make(map[syscall.Signal]time.Time)}
+	signalPid = fp.signal
+
+	r := &RenderedNetwork{Runner: &fakeRunner{out: fp.pids}}
+	if err := r.killProcesses("tns0"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fp.signals) != 0 {
+		t.Errorf("signals %q sent without changing the host", fp.signals)
+	}
+}
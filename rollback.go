@@ -0,0 +1,136 @@
+package netdef
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Kinds of resource recorded as they are created.
+const (
+	resBridge    = "bridge"
+	resNamespace = "namespace"
+	resVeth      = "veth"
+	resVethPair  = "veth pair"
+)
+
+// resource is a bridge, namespace or veth created on the host. A veth pair
+// is created, and deleted, as one resource.
+type resource struct {
+	Kind string
+	Name string
+	// Peer is the second veth of a pair.
+	Peer string
+	// Type is the type of a bridge.
+	Type string
+}
+
+// track journals res and then creates it, recording it as created if that
+// succeeds.
+func (r *RenderedNetwork) track(res resource, create func() error) error {
+	if err := r.journal(opCreate, res, ""); err != nil {
+		return err
+	}
+	if err := create(); err != nil {
+		// Best effort, a failure here only leaves a stale entry in the
+		// journal.
+		r.journal(opDelete, res, "")
+		return err
+	}
+	r.resources = append(r.resources, res)
+	return nil
+}
+
+// Rollback deletes every resource r has created, or read from a journal,
+// newest first.
+func (r *RenderedNetwork) Rollback() error {
+	return r.rollback(0)
+}
+
+// rollback deletes the resources created since the first n, newest first.
+// Resources already deleted some other way, e.g. veths that went away with
+// their namespace, are skipped. It stops at the first error, leaving that
+// resource and everything older in r.
+func (r *RenderedNetwork) rollback(n int) error {
+	for i := len(r.resources) - 1; i >= n; i-- {
+		if err := r.undo(r.resources[i]); err != nil {
+			return errors.Wrapf(err, "deleting %s %s", r.resources[i].Kind, r.resources[i].Name)
+		}
+		r.resources = r.resources[:i]
+	}
+	return nil
+}
+
+// undo deletes a created resource if r still tracks it.
+func (r *RenderedNetwork) undo(res resource) error {
+	switch res.Kind {
+	case resBridge:
+		if _, ok := r.Bridges[res.Name]; !ok {
+			return nil
+		}
+		return r.DeleteBridge(res.Name)
+	case resNamespace:
+		if !r.hasNamespace(res.Name) {
+			return nil
+		}
+		return r.DeleteNamespace(res.Name)
+	case resVeth, resVethPair:
+		// Deleting either end of a pair deletes both, and an end that
+		// was moved into a namespace is no longer ours to delete.
+		for _, name := range []string{res.Name, res.Peer} {
+			if _, ok := r.Interfaces[name]; ok && name != "" {
+				if err := r.DeleteInterface(name); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		delete(r.Interfaces, res.Name)
+		delete(r.Interfaces, res.Peer)
+	}
+	return nil
+}
+
+// hasNamespace reports whether r tracks ns as the namespace of a peer, router
+// or NAT.
+func (r *RenderedNetwork) hasNamespace(ns string) bool {
+	for _, m := range []map[string]string{r.Namespaces, r.Routers, r.Nats} {
+		for _, v := range m {
+			if v == ns {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forgetNamespace drops ns, and the links and processes in it, from r.
+func (r *RenderedNetwork) forgetNamespace(ns string) {
+	forget := func(names map[string]string, links map[string]map[string]*PeerLink) {
+		for k, v := range names {
+			if v == ns {
+				delete(names, k)
+				delete(links, k)
+			}
+		}
+	}
+	forget(r.Namespaces, r.PeerLinks)
+	forget(r.Routers, r.RouterLinks)
+	forget(r.Nats, r.NatLinks)
+	r.forgetProcesses(ns)
+}
+
+// forgetBridge drops bridge, and the networks and patches using it, from r.
+func (r *RenderedNetwork) forgetBridge(bridge string) {
+	for n, br := range r.Networks {
+		if br == bridge {
+			delete(r.Networks, n)
+		}
+	}
+	for name, pt := range r.Patches {
+		for _, br := range pt.Bridges {
+			if br == bridge {
+				delete(r.Patches, name)
+				break
+			}
+		}
+	}
+}
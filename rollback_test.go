@@ -0,0 +1,128 @@
+package netdef
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// rollbackConfig returns a config with one network and two peers on it.
+func rollbackConfig() *Config {
+	cfg := testConfig()
+	cfg.Networks = []Network{{Name: "lan", IpRange: "10.0.0.0/24"}}
+	cfg.Peers = []Peer{
+		{Name: "a", Links: map[string]*LinkOpts{"lan": nil}},
+		{Name: "b", Links: map[string]*LinkOpts{"lan": {Latency: "10ms"}}},
+	}
+	return cfg
+}
+
+func TestRenderRollback(t *testing.T) {
+	cases := []struct {
+		fail string
+		undo []string
+	}{
+		{
+			fail: "ip link add name tbr0",
+		},
+		{
+			fail: "ip netns add tns0",
+			undo: []string{"ip link del tbr0 type bridge"},
+		},
+		{
+			// The veth pair of b was never created, so there is
+			// nothing of it to delete.
+			fail: "ip link add tveth1",
+			undo: []string{
+				"ip netns del tns1",
+				"ip link del ttap0",
+				"ip netns del tns0",
+				"ip link del tbr0 type bridge",
+			},
+		},
+		{
+			// Both ends of the pair of b are still in the global
+			// namespace.
+			fail: "ip link set tveth1 netns",
+			undo: []string{
+				"ip link del tveth1",
+				"ip netns del tns1",
+				"ip link del ttap0",
+				"ip netns del tns0",
+				"ip link del tbr0 type bridge",
+			},
+		},
+		{
+			fail: "tc qdisc replace",
+			undo: []string{
+				"ip link del ttap1",
+				"ip netns del tns1",
+				"ip link del ttap0",
+				"ip netns del tns0",
+				"ip link del tbr0 type bridge",
+			},
+		},
+	}
+	for _, c := range cases {
+		f := &fakeRunner{fail: map[string]error{c.fail: errors.New("failed")}}
+		r := rollbackConfig().NewRenderedNetwork()
+		r.Runner = f
+		if err := rollbackConfig().Render(r); err == nil {
+			t.Errorf("%s: render succeeded", c.fail)
+			continue
+		}
+
+		var undo []string
+		for i, cmd := range f.cmds {
+			if strings.HasPrefix(cmd, c.fail) {
+				undo = f.cmds[i+1:]
+				break
+			}
+		}
+		if strings.Join(undo, "\n") != strings.Join(c.undo, "\n") {
+			t.Errorf("%s: got undo commands\n%s\nwant\n%s", c.fail, strings.Join(undo, "\n"), strings.Join(c.undo, "\n"))
+		}
+		if left := len(r.Bridges) + len(r.Namespaces) + len(r.Interfaces); left != 0 {
+			t.Errorf("%s: %d resources left in the render", c.fail, left)
+		}
+	}
+}
+
+func TestRenderKeepPartial(t *testing.T) {
+	f := &fakeRunner{fail: map[string]error{"ip link set tveth1 netns": errors.New("failed")}}
+	r := rollbackConfig().NewRenderedNetwork()
+	r.Runner = f
+	r.KeepPartial = true
+	if err := rollbackConfig().Render(r); err == nil {
+		t.Fatal("render succeeded")
+	}
+
+	if got := f.cmds[len(f.cmds)-1]; !strings.HasPrefix(got, "ip link set tveth1 netns") {
+		t.Errorf("ran %q after the failure", got)
+	}
+	if _, ok := r.Bridges["tbr0"]; !ok {
+		t.Error("bridge tbr0 dropped from the render")
+	}
+	if r.Namespaces["a"] != "tns0" || r.Namespaces["b"] != "tns1" {
+		t.Errorf("got namespaces %v, want those of both peers", r.Namespaces)
+	}
+	if _, ok := r.Interfaces["tveth1"]; !ok {
+		t.Errorf("got interfaces %v, want tveth1 among them", r.Interfaces)
+	}
+
+	// Rolling back later deletes what was kept.
+	f.cmds = nil
+	if err := r.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ip link del tveth1",
+		"ip netns del tns1",
+		"ip link del ttap0",
+		"ip netns del tns0",
+		"ip link del tbr0 type bridge",
+	}
+	if strings.Join(f.cmds, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got rollback commands\n%s\nwant\n%s", strings.Join(f.cmds, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,169 @@
+package netdef
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// routedLink is a link between two networks realized as a router namespace
+// with an interface on each network, rather than by patching their bridges.
+type routedLink struct {
+	name string
+	a, b string
+	opts *LinkOpts
+}
+
+// routedLinks returns the routed links between nets, ordered by name.
+func routedLinks(nets map[string]*Network) ([]routedLink, error) {
+	var out []routedLink
+	for name, n := range nets {
+		for target, l := range n.Links {
+			if l == nil || !l.Routed {
+				continue
+			}
+			if target == name {
+				return nil, fmt.Errorf("network %s has a routed link to itself", name)
+			}
+			out = append(out, routedLink{
+				name: name + ":" + target,
+				a:    name,
+				b:    target,
+				opts: l,
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out, nil
+}
+
+// hop is the first step on the way to a network: a router and the network
+// through which it is reached.
+type hop struct {
+	router  string
+	network string
+}
+
+// nextHops finds, for a host attached to the given networks, the first hop on
+// a shortest path to every other network reachable through routed links.
+func nextHops(attached []string, links []routedLink) map[string]hop {
+	type edge struct {
+		router string
+		to     string
+	}
+	adj := make(map[string][]edge)
+	for _, rl := range links {
+		adj[rl.a] = append(adj[rl.a], edge{rl.name, rl.b})
+		adj[rl.b] = append(adj[rl.b], edge{rl.name, rl.a})
+	}
+
+	start := append([]string(nil), attached...)
+	sort.Strings(start)
+
+	seen := make(map[string]bool)
+	for _, n := range start {
+		seen[n] = true
+	}
+
+	first := make(map[string]hop)
+	queue := start
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, e := range adj[cur] {
+			if seen[e.to] {
+				continue
+			}
+			seen[e.to] = true
+			if h, ok := first[cur]; ok {
+				first[e.to] = h
+			} else {
+				first[e.to] = hop{router: e.router, network: cur}
+			}
+			queue = append(queue, e.to)
+		}
+	}
+	return first
+}
+
+// CreateRouter creates a namespace for a router and, once it exists, logs a
+// mapping of the router name to the generated namespace name. Forwarding is
+// enabled within the namespace.
+func (r *RenderedNetwork) CreateRouter(name string) error {
+	err := r.createNamespace("Router", "router "+name, func(ns string) {
+		if r.Routers == nil {
+			r.Routers = make(map[string]string)
+		}
+		r.Routers[name] = ns
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.enableForwarding(r.Routers[name])
+}
+
+// enableForwarding turns on IPv4 and IPv6 forwarding within a namespace.
+func (r *RenderedNetwork) enableForwarding(ns string) error {
+	if err := r.backend().SetSysctl(ns, "net.ipv4.ip_forward", "1"); err != nil {
+		return errors.Wrap(err, "enable forwarding")
+	}
+	if err := r.backend().SetSysctl(ns, "net.ipv6.conf.all.forwarding", "1"); err != nil {
+		return errors.Wrap(err, "enable forwarding")
+	}
+	return nil
+}
+
+// recordRouterLink stores the record of a router's link to a network.
+func (r *RenderedNetwork) recordRouterLink(router, network string, pl *PeerLink) {
+	if r.RouterLinks == nil {
+		r.RouterLinks = make(map[string]map[string]*PeerLink)
+	}
+	if r.RouterLinks[router] == nil {
+		r.RouterLinks[router] = make(map[string]*PeerLink)
+	}
+	r.RouterLinks[router][network] = pl
+}
+
+// createRouters creates a router for each routed link and connects it to
+// both networks. The link options apply to the router's port on the first
+// network.
+func (r *RenderedNetwork) createRouters(links []routedLink, addrs map[string]map[string][]string) error {
+	for _, rl := range links {
+		if err := r.CreateRouter(rl.name); err != nil {
+			return errors.Wrapf(err, "creating router %s", rl.name)
+		}
+		ns := r.Routers[rl.name]
+
+		pl, err := r.attach("router "+rl.name+" on "+rl.a, ns, r.Networks[rl.a], addrs[rl.name][rl.a], rl.opts)
+		if err != nil {
+			return errors.Wrapf(err, "connecting router %s", rl.name)
+		}
+		r.recordRouterLink(rl.name, rl.a, pl)
+
+		pl, err = r.attach("router "+rl.name+" on "+rl.b, ns, r.Networks[rl.b], addrs[rl.name][rl.b], nil)
+		if err != nil {
+			return errors.Wrapf(err, "connecting router %s", rl.name)
+		}
+		r.recordRouterLink(rl.name, rl.b, pl)
+	}
+	return nil
+}
+
+// sameFamily returns the address, without its mask, from addrs that is of the
+// same family as the CIDR dst.
+func sameFamily(dst string, addrs []string) string {
+	v6 := isIPv6(dst)
+	for _, a := range addrs {
+		ip, _, err := net.ParseCIDR(a)
+		if err != nil {
+			continue
+		}
+		if (ip.To4() == nil) == v6 {
+			return ip.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package netdef
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNextHops(t *testing.T) {
+	// a - b - c, with d hanging off b and e on its own.
+	links := []routedLink{
+		{name: "a:b", a: "a", b: "b"},
+		{name: "b:c", a: "b", b: "c"},
+		{name: "d:b", a: "d", b: "b"},
+	}
+
+	cases := []struct {
+		attached []string
+		want     map[string]hop
+	}{
+		{
+			attached: []string{"a"},
+			want: map[string]hop{
+				"b": {"a:b", "a"},
+				"c": {"a:b", "a"},
+				"d": {"a:b", "a"},
+			},
+		},
+		{
+			attached: []string{"c"},
+			want: map[string]hop{
+				"b": {"b:c", "c"},
+				"a": {"b:c", "c"},
+				"d": {"b:c", "c"},
+			},
+		},
+		{
+			// Ties go to the attached network that sorts first.
+			attached: []string{"c", "a"},
+			want: map[string]hop{
+				"b": {"a:b", "a"},
+				"d": {"a:b", "a"},
+			},
+		},
+		{
+			attached: []string{"b"},
+			want: map[string]hop{
+				"a": {"a:b", "b"},
+				"c": {"b:c", "b"},
+				"d": {"d:b", "b"},
+			},
+		},
+		{
+			attached: []string{"e"},
+			want:     map[string]hop{},
+		},
+	}
+	for _, c := range cases {
+		got := nextHops(c.attached, links)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("attached to %v: got %v, want %v", c.attached, got, c.want)
+		}
+	}
+}
+
+func TestRoutedLinks(t *testing.T) {
+	nets := map[string]*Network{
+		"b": {Name: "b", Links: map[string]*LinkOpts{"a": {Routed: true}, "c": nil}},
+		"a": {Name: "a", Links: map[string]*LinkOpts{"c": {Routed: true}}},
+		"c": {Name: "c"},
+	}
+	links, err := routedLinks(nets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, rl := range links {
+		names = append(names, rl.name)
+	}
+	if want := []string{"a:c", "b:a"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got routed links %v, want %v", names, want)
+	}
+
+	nets["c"].Links = map[string]*LinkOpts{"c": {Routed: true}}
+	if _, err := routedLinks(nets); err == nil {
+		t.Error("routed link to itself accepted")
+	}
+}
+
+func TestSameFamily(t *testing.T) {
+	addrs := []string{"10.0.0.1/24", "fd00::1/64"}
+	cases := []struct {
+		dst, want string
+	}{
+		{"0.0.0.0/0", "10.0.0.1"},
+		{"10.1.0.0/16", "10.0.0.1"},
+		{"fd01::/64", "fd00::1"},
+	}
+	for _, c := range cases {
+		if got := sameFamily(c.dst, addrs); got != c.want {
+			t.Errorf("sameFamily(%s): got %q, want %q", c.dst, got, c.want)
+		}
+	}
+	if got := sameFamily("fd01::/64", addrs[:1]); got != "" {
+		t.Errorf("sameFamily without an IPv6 address: got %q", got)
+	}
+}
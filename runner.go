@@ -0,0 +1,207 @@
+package netdef
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/whyrusleeping/go-ctrlnet"
+)
+
+// Runner executes the commands netdef uses to modify the host. Every side
+// effect of a RenderedNetwork goes through its Runner, which allows commands to
+// be printed, recorded or faked instead of executed.
+type Runner interface {
+	// Run executes a command, returning an error containing its output if it
+	// fails.
+	Run(args ...string) error
+	// Output executes a command and returns its standard output. It is only
+	// used for commands that query the host without modifying it.
+	Output(args ...string) ([]byte, error)
+}
+
+// LinkSetter is implemented by Runners that apply link settings directly
+// instead of through tc commands passed to Run.
+type LinkSetter interface {
+	SetLink(iface string, s *ctrlnet.LinkSettings) error
+}
+
+// ExecRunner runs commands on the host. It is the default Runner.
+type ExecRunner struct{}
+
+// Run executes a command on the host.
+func (ExecRunner) Run(args ...string) error {
+	return callBin(args...)
+}
+
+// Output executes a command on the host and returns its standard output.
+func (ExecRunner) Output(args ...string) ([]byte, error) {
+	_, err := exec.LookPath(args[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "looking up binary failed")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("%s (exit code %d)", strings.TrimRight(string(ee.Stderr), "\n"), ee.ExitCode())
+		}
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// SetLink applies link settings to an interface with go-ctrlnet.
+func (ExecRunner) SetLink(iface string, s *ctrlnet.LinkSettings) error {
+	return ctrlnet.SetLink(iface, s)
+}
+
+// changesHost reports whether commands given to run, and the operations of b,
+// modify the host rather than being printed or faked.
+func changesHost(run Runner, b Backend) bool {
+	if _, ok := b.(NetlinkBackend); ok {
+		return true
+	}
+	switch run := run.(type) {
+	case ExecRunner, *ExecRunner:
+		return true
+	case *Recorder:
+		return changesHost(run.runner(), nil)
+	}
+	return false
+}
+
+// changesHost reports whether r modifies the host. Side effects netdef has
+// outside of the Runner and Backend, such as the host lock, namespace markers
+// and signals, are skipped when it does not.
+func (r *RenderedNetwork) changesHost() bool {
+	return changesHost(r.runner(), r.Backend)
+}
+
+// DryRunner prints the commands it is given instead of running them. Queries
+// made through Output are still executed, since they do not modify the host and
+// are needed to pick names that do not collide with existing ones.
+type DryRunner struct {
+	// Out is where commands are printed.
+	Out io.Writer
+}
+
+// Run prints a command.
+func (d *DryRunner) Run(args ...string) error {
+	_, err := fmt.Fprintln(d.Out, shellJoin(args))
+	return err
+}
+
+// Output executes a query on the host.
+func (d *DryRunner) Output(args ...string) ([]byte, error) {
+	return ExecRunner{}.Output(args...)
+}
+
+// Recorder runs commands with another Runner and writes every command that
+// succeeds to a transcript. The transcript is a shell script that replays the
+// changes made to the host.
+type Recorder struct {
+	// Runner executes the recorded commands. If nil, commands are executed
+	// on the host.
+	Runner Runner
+	// Out is where the transcript is written.
+	Out io.Writer
+
+	lk      sync.Mutex
+	started bool
+}
+
+// Run executes a command and appends it to the transcript.
+func (rec *Recorder) Run(args ...string) error {
+	return rec.record(args, rec.runner().Run(args...))
+}
+
+// SetLink applies link settings with the Runner if it is a LinkSetter, and
+// otherwise runs the equivalent tc command. Either way the tc command is
+// appended to the transcript.
+func (rec *Recorder) SetLink(iface string, s *ctrlnet.LinkSettings) error {
+	ls, ok := rec.runner().(LinkSetter)
+	if !ok {
+		return rec.Run(netemArgs(iface, s)...)
+	}
+	return rec.record(netemArgs(iface, s), ls.SetLink(iface, s))
+}
+
+// record appends args to the transcript, marked as failed if err is not nil,
+// and returns err.
+func (rec *Recorder) record(args []string, err error) error {
+	rec.lk.Lock()
+	defer rec.lk.Unlock()
+	if !rec.started {
+		if _, werr := fmt.Fprintln(rec.Out, "#!/bin/sh\nset -e"); werr != nil {
+			return werr
+		}
+		rec.started = true
+	}
+
+	line := shellJoin(args)
+	if err != nil {
+		line = "# failed: " + line
+	}
+	if _, werr := fmt.Fprintln(rec.Out, line); werr != nil && err == nil {
+		return werr
+	}
+
+	return err
+}
+
+// Output executes a query. Queries are not recorded.
+func (rec *Recorder) Output(args ...string) ([]byte, error) {
+	return rec.runner().Output(args...)
+}
+
+func (rec *Recorder) runner() Runner {
+	if rec.Runner == nil {
+		return ExecRunner{}
+	}
+	return rec.Runner
+}
+
+// netemArgs returns a tc command equivalent to applying s to iface.
+func netemArgs(iface string, s *ctrlnet.LinkSettings) []string {
+	args := []string{"tc", "qdisc", "replace", "dev", iface, "root", "netem"}
+	if s.Latency != 0 || s.Jitter != 0 {
+		args = append(args, "delay", fmt.Sprintf("%dms", s.Latency))
+		if s.Jitter != 0 {
+			args = append(args, fmt.Sprintf("%dms", s.Jitter))
+		}
+	}
+	if s.PacketLoss != 0 {
+		args = append(args, "loss", fmt.Sprintf("%d%%", s.PacketLoss))
+	}
+	if s.Bandwidth != 0 {
+		args = append(args, "rate", fmt.Sprintf("%dbit", s.Bandwidth))
+	}
+	return args
+}
+
+// shellJoin joins args into a command line that can be pasted into a shell.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./:=@%+,", c)) {
+			return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+		}
+	}
+	return s
+}
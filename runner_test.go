@@ -0,0 +1,222 @@
+package netdef
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/whyrusleeping/go-ctrlnet"
+)
+
+func TestMain(m *testing.M) {
+	// Keep the lock, markers, instances and renders of tests away from the
+	// host's.
+	dir, err := ioutil.TempDir("", "netdef-test")
+	if err != nil {
+		panic(err)
+	}
+	LockPath = filepath.Join(dir, "lock")
+	MarkerDir = filepath.Join(dir, "netns")
+	StateDir = filepath.Join(dir, "instances")
+	RenderDir = filepath.Join(dir, "renders")
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// fakeRunner records the commands it is given instead of running them.
+// Commands starting with a key of fail fail with its value. Queries are
+// answered by out, or return nothing if it is nil.
+type fakeRunner struct {
+	cmds []string
+	fail map[string]error
+	out  func(cmd string) ([]byte, error)
+}
+
+func (f *fakeRunner) Run(args ...string) error {
+	cmd := strings.Join(args, " ")
+	f.cmds = append(f.cmds, cmd)
+	for prefix, err := range f.fail {
+		if strings.HasPrefix(cmd, prefix) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeRunner) Output(args ...string) ([]byte, error) {
+	if f.out == nil {
+		return nil, nil
+	}
+	return f.out(strings.Join(args, " "))
+}
+
+// grep returns the commands that contain s.
+func (f *fakeRunner) grep(s string) []string {
+	var out []string
+	for _, c := range f.cmds {
+		if strings.Contains(c, s) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// testConfig returns a config with linux bridges and prefixes that do not
+// occur on the host, so that sequential names do not depend on it.
+func testConfig() *Config {
+	return &Config{
+		Bridge: BridgeLinux,
+		Prefixes: map[string]string{
+			"Bridge":    "tbr",
+			"Interface": "tveth",
+			"Patch":     "tpatch",
+			"Port":      "ttap",
+			"Namespace": "tns",
+			"Router":    "trt",
+			"Nat":       "tnat",
+		},
+	}
+}
+
+// renderFake renders cfg with a fakeRunner.
+func renderFake(t *testing.T, cfg *Config) (*RenderedNetwork, *fakeRunner) {
+	t.Helper()
+	f := &fakeRunner{}
+	r := cfg.NewRenderedNetwork()
+	r.Runner = f
+	if err := cfg.Render(r); err != nil {
+		t.Fatal(err)
+	}
+	return r, f
+}
+
+func TestChangesHost(t *testing.T) {
+	cases := []struct {
+		name    string
+		runner  Runner
+		backend Backend
+		want    bool
+	}{
+		{"default", nil, nil, true},
+		{"exec", ExecRunner{}, nil, true},
+		{"dry run", &DryRunner{Out: &bytes.Buffer{}}, nil, false},
+		{"fake", &fakeRunner{}, nil, false},
+		{"recording", &Recorder{Out: &bytes.Buffer{}}, nil, true},
+		{"recording a fake", &Recorder{Runner: &fakeRunner{}, Out: &bytes.Buffer{}}, nil, false},
+		{"netlink", &fakeRunner{}, NetlinkBackend{}, true},
+	}
+	for _, c := range cases {
+		r := &RenderedNetwork{Runner: c.runner, Backend: c.backend}
+		if got := r.changesHost(); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	var out bytes.Buffer
+	f := &fakeRunner{fail: map[string]error{"false": errors.New("failed")}}
+	rec := &Recorder{Runner: f, Out: &out}
+
+	rec.Run("ip", "link", "set", "dev", "tveth0", "alias", "a b")
+	if err := rec.Run("false"); err == nil {
+		t.Error("failing command succeeded")
+	}
+
+	want := "#!/bin/sh\nset -e\nip link set dev tveth0 alias 'a b'\n# failed: false\n"
+	if out.String() != want {
+		t.Errorf("got transcript %q, want %q", out.String(), want)
+	}
+	if len(f.cmds) != 2 {
+		t.Errorf("got %d commands run, want 2", len(f.cmds))
+	}
+}
+
+// linkSetter is a fakeRunner that applies link settings itself.
+type linkSetter struct {
+	fakeRunner
+	links []string
+}
+
+func (ls *linkSetter) SetLink(iface string, s *ctrlnet.LinkSettings) error {
+	ls.links = append(ls.links, iface)
+	return nil
+}
+
+func TestRecorderSetLink(t *testing.T) {
+	s := &ctrlnet.LinkSettings{Latency: 10}
+	want := "#!/bin/sh\nset -e\ntc qdisc replace dev ttap0 root netem delay 10ms\n"
+
+	// Settings go to a Runner that applies them itself, as they would
+	// without the Recorder.
+	var out bytes.Buffer
+	ls := &linkSetter{}
+	if err := (&Recorder{Runner: ls, Out: &out}).SetLink("ttap0", s); err != nil {
+		t.Fatal(err)
+	}
+	if len(ls.links) != 1 || len(ls.cmds) != 0 {
+		t.Errorf("got links %q and commands %q, want the link set directly", ls.links, ls.cmds)
+	}
+	if out.String() != want {
+		t.Errorf("got transcript %q, want %q", out.String(), want)
+	}
+
+	// Other Runners get the tc command.
+	out.Reset()
+	f := &fakeRunner{}
+	if err := (&Recorder{Runner: f, Out: &out}).SetLink("ttap0", s); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.cmds) != 1 || f.cmds[0] != "tc qdisc replace dev ttap0 root netem delay 10ms" {
+		t.Errorf("got commands %q, want the tc command", f.cmds)
+	}
+	if out.String() != want {
+		t.Errorf("got transcript %q, want %q", out.String(), want)
+	}
+}
+
+func TestRenderRunner(t *testing.T) {
+	cfg := &Config{
+		Networks: []Network{{Name: "lan", IpRange: "10.0.0.0/24"}},
+		Peers: []Peer{
+			{Name: "a", Links: map[string]*LinkOpts{"lan": nil}},
+			{Name: "b", Links: map[string]*LinkOpts{"lan": {Latency: "10ms"}}},
+		},
+		// Prefixes that do not occur on the host keep the names fixed.
+		Prefixes: map[string]string{
+			"Bridge":    "tbr",
+			"Interface": "tveth",
+			"Port":      "ttap",
+			"Namespace": "tns",
+		},
+	}
+	f := &fakeRunner{}
+	r := cfg.NewRenderedNetwork()
+	r.Runner = f
+	if err := cfg.Render(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Link settings go through the runner as tc commands, since a
+	// fakeRunner cannot set them directly.
+	all := strings.Join(f.cmds, "\n")
+	for _, want := range []string{
+		"ip netns add tns1",
+		"ip netns exec tns0 ip addr add 10.0.0.1/24 dev tveth0",
+		"tc qdisc replace dev ttap1 root netem delay 10ms",
+		"ip netns del tns1",
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("missing %q in\n%s", want, all)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package netdef
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Event is a timed change to a peer's link in a running network.
+type Event struct {
+	// At is the time of the event relative to the start of the schedule,
+	// e.g. "30s".
+	At string
+	// Peer and Network select the link to change.
+	Peer    string
+	Network string
+	// Link, if set, replaces the options of the link. An empty LinkOpts
+	// removes them.
+	Link *LinkOpts
+	// State, if set, takes the link "down" or brings it back "up".
+	State string
+
+	at time.Duration
+}
+
+// validateSchedule checks that every Event refers to an existing link and
+// parses its time and options.
+func (cfg *Config) validateSchedule() error {
+	links := make(map[string]map[string]*LinkOpts)
+	for _, p := range cfg.Peers {
+		links[p.Name] = p.Links
+	}
+
+	for i := range cfg.Schedule {
+		ev := &cfg.Schedule[i]
+
+		at, err := time.ParseDuration(ev.At)
+		if err != nil {
+			return errors.Wrapf(err, "schedule event %d", i)
+		}
+		if at < 0 {
+			return fmt.Errorf("schedule event %d: negative time %s", i, ev.At)
+		}
+		ev.at = at
+
+		pl, ok := links[ev.Peer]
+		if !ok {
+			return fmt.Errorf("schedule event %d: no such peer: %s", i, ev.Peer)
+		}
+		if _, ok := pl[ev.Network]; !ok {
+			return fmt.Errorf("schedule event %d: peer %s has no link to network %s", i, ev.Peer, ev.Network)
+		}
+
+		switch ev.State {
+		case "", "up", "down":
+		default:
+			return fmt.Errorf("schedule event %d: unknown link state %q", i, ev.State)
+		}
+
+		if ev.Link != nil {
+			if err := ev.Link.Parse(); err != nil {
+				return errors.Wrapf(err, "schedule event %d", i)
+			}
+		}
+	}
+	return nil
+}
+
+// SetLinkState takes a peer's link to a network "down" or brings it back "up"
+// by changing the state of its port.
+func (r *RenderedNetwork) SetLinkState(peer, network, state string) error {
+	pl, err := r.PeerLink(peer, network)
+	if err != nil {
+		return err
+	}
+
+	if err := r.SetDev(pl.Port, state); err != nil {
+		return errors.Wrapf(err, "setting link of %s to %s %s", peer, network, state)
+	}
+	pl.Down = state == "down"
+	return nil
+}
+
+// RunSchedule applies the events of a Config's schedule to r at their times,
+// measured from when it is called, or one after the other if r.NoWait is set.
+// It returns once every event has been applied, or early without error if stop
+// is closed.
+func (r *RenderedNetwork) RunSchedule(cfg *Config, stop <-chan struct{}) error {
+	if err := cfg.validateSchedule(); err != nil {
+		return err
+	}
+
+	events := make([]Event, len(cfg.Schedule))
+	copy(events, cfg.Schedule)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].at < events[j].at })
+
+	start := time.Now()
+	for _, ev := range events {
+		d := time.Until(start.Add(ev.at))
+		if r.NoWait {
+			d = 0
+		}
+		wait := time.NewTimer(d)
+		select {
+		case <-wait.C:
+		case <-stop:
+			wait.Stop()
+			return nil
+		}
+
+		if ev.Link != nil {
+			if err := r.UpdateLink(ev.Peer, ev.Network, ev.Link); err != nil {
+				return errors.Wrapf(err, "at %s", ev.At)
+			}
+		}
+		if ev.State != "" {
+			if err := r.SetLinkState(ev.Peer, ev.Network, ev.State); err != nil {
+				return errors.Wrapf(err, "at %s", ev.At)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package netdef
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timedRunner is a fakeRunner that also records when each command ran.
+type timedRunner struct {
+	fakeRunner
+	at    []time.Duration
+	start time.Time
+}
+
+func (tr *timedRunner) Run(args ...string) error {
+	tr.at = append(tr.at, time.Since(tr.start))
+	return tr.fakeRunner.Run(args...)
+}
+
+func scheduleConfig(events ...Event) *Config {
+	cfg := testConfig()
+	cfg.Networks = []Network{{Name: "lan", IpRange: "10.0.0.0/24"}}
+	cfg.Peers = []Peer{{Name: "a", Links: map[string]*LinkOpts{"lan": nil}}}
+	cfg.Schedule = events
+	return cfg
+}
+
+func TestRunSchedule(t *testing.T) {
+	cfg := scheduleConfig(
+		Event{At: "100ms", Peer: "a", Network: "lan", State: "up"},
+		Event{At: "0s", Peer: "a", Network: "lan", Link: &LinkOpts{Latency: "20ms"}},
+		Event{At: "50ms", Peer: "a", Network: "lan", State: "down"},
+		Event{At: "50ms", Peer: "a", Network: "lan", Link: &LinkOpts{}},
+	)
+	r, _ := renderFake(t, cfg)
+	tr := &timedRunner{start: time.Now()}
+	r.Runner = tr
+
+	if err := r.RunSchedule(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events at the same time keep their order in the config.
+	want := []string{
+		"tc qdisc replace dev ttap0 root netem delay 20ms",
+		"ip link set dev ttap0 down",
+		"tc qdisc del dev ttap0 root",
+		"ip link set dev ttap0 up",
+	}
+	if strings.Join(tr.cmds, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got commands\n%s\nwant\n%s", strings.Join(tr.cmds, "\n"), strings.Join(want, "\n"))
+	}
+	for i, at := range []time.Duration{0, 50 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond} {
+		if tr.at[i] < at {
+			t.Errorf("%s ran after %s, before its time %s", tr.cmds[i], tr.at[i], at)
+		}
+	}
+	if pl, _ := r.PeerLink("a", "lan"); pl.Down || !pl.Link.empty() {
+		t.Errorf("got link %+v after the schedule", pl)
+	}
+}
+
+func TestRunScheduleFailure(t *testing.T) {
+	cfg := scheduleConfig(
+		Event{At: "0s", Peer: "a", Network: "lan", Link: &LinkOpts{Latency: "20ms"}},
+		Event{At: "10ms", Peer: "a", Network: "lan", State: "down"},
+		Event{At: "20ms", Peer: "a", Network: "lan", State: "up"},
+	)
+	r, _ := renderFake(t, cfg)
+	f := &fakeRunner{fail: map[string]error{"ip link set dev ttap0 down": errors.New("failed")}}
+	r.Runner = f
+
+	err := r.RunSchedule(cfg, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "at 10ms: ") {
+		t.Fatalf("got error %v, want one for the event at 10ms", err)
+	}
+	if len(f.cmds) != 2 {
+		t.Errorf("got commands %q, want none after the failed event", f.cmds)
+	}
+}
+
+func TestRunScheduleStop(t *testing.T) {
+	cfg := scheduleConfig(
+		Event{At: "0s", Peer: "a", Network: "lan", State: "down"},
+		Event{At: "1h", Peer: "a", Network: "lan", State: "up"},
+	)
+	r, _ := renderFake(t, cfg)
+	f := &fakeRunner{}
+	r.Runner = f
+
+	stop := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+	if err := r.RunSchedule(cfg, stop); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.cmds) != 1 {
+		t.Errorf("got commands %q, want only the first event", f.cmds)
+	}
+}
+
+func TestRunScheduleNoWait(t *testing.T) {
+	cfg := scheduleConfig(
+		Event{At: "1h", Peer: "a", Network: "lan", State: "up"},
+		Event{At: "30m", Peer: "a", Network: "lan", State: "down"},
+	)
+	r, _ := renderFake(t, cfg)
+	f := &fakeRunner{}
+	r.Runner = f
+	r.NoWait = true
+
+	if err := r.RunSchedule(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ip link set dev ttap0 down", "ip link set dev ttap0 up"}
+	if strings.Join(f.cmds, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got commands %q, want %q", f.cmds, want)
+	}
+}
@@ -0,0 +1,288 @@
+package netdef
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Restart policies understood by Workload.Restart.
+const (
+	// RestartNever runs a workload once. It is the default.
+	RestartNever = "never"
+	// RestartOnFailure starts a workload again if it exits with an error.
+	RestartOnFailure = "on-failure"
+	// RestartAlways starts a workload again whenever it exits.
+	RestartAlways = "always"
+)
+
+// RestartDelay is how long RunWorkloads waits before restarting a workload.
+var RestartDelay = time.Second
+
+// Workload is a command run on a peer by RunWorkloads.
+type Workload struct {
+	// Name identifies the workload among those of its peer. It defaults to
+	// the base name of the program.
+	Name string
+	// Command is the program to run and its arguments.
+	Command []string
+	// Delay is how long after the start of the run the workload is started,
+	// e.g. "5s".
+	Delay string
+	// Restart is when the workload is started again after it exits:
+	// "never" (the default), "on-failure" or "always".
+	Restart string
+	// Env holds environment variables for the workload, in addition to
+	// those of netdef.
+	Env map[string]string
+
+	name  string
+	delay time.Duration
+}
+
+// WorkloadResult is the outcome of a workload run by RunWorkloads.
+type WorkloadResult struct {
+	Peer    string
+	Name    string
+	Command []string
+	// ExitCodes holds the exit code of every run of the workload, or -1 for
+	// runs ended by a signal.
+	ExitCodes []int
+	// Stopped is set if the workload was still running at the end of the
+	// run and was stopped.
+	Stopped bool
+	// Error describes why the workload could not be started, if it could
+	// not.
+	Error string
+}
+
+// Failed reports whether the workload could not be started or its last run
+// failed. Workloads that were stopped did not fail.
+func (wr *WorkloadResult) Failed() bool {
+	if wr.Error != "" {
+		return true
+	}
+	n := len(wr.ExitCodes)
+	return !wr.Stopped && n > 0 && wr.ExitCodes[n-1] != 0
+}
+
+// validateWorkloads checks and parses the workloads of every peer.
+func (cfg *Config) validateWorkloads() error {
+	for _, p := range cfg.Peers {
+		names := make(map[string]bool)
+		for i := range p.Workloads {
+			w := &p.Workloads[i]
+			if len(w.Command) == 0 {
+				return fmt.Errorf("peer %s: workload %d has no command", p.Name, i)
+			}
+
+			w.name = w.Name
+			if w.name == "" {
+				w.name = filepath.Base(w.Command[0])
+			}
+			if strings.ContainsRune(w.name, '/') {
+				return fmt.Errorf("peer %s: workload name %s contains a slash", p.Name, w.name)
+			}
+			if names[w.name] {
+				return fmt.Errorf("peer %s: duplicate workload name %s", p.Name, w.name)
+			}
+			names[w.name] = true
+
+			w.delay = 0
+			if w.Delay != "" {
+				d, err := time.ParseDuration(w.Delay)
+				if err != nil {
+					return errors.Wrapf(err, "peer %s: workload %s", p.Name, w.name)
+				}
+				if d < 0 {
+					return fmt.Errorf("peer %s: workload %s: negative delay %s", p.Name, w.name, w.Delay)
+				}
+				w.delay = d
+			}
+
+			switch w.Restart {
+			case "", RestartNever, RestartOnFailure, RestartAlways:
+			default:
+				return fmt.Errorf("peer %s: workload %s: unknown restart policy %q", p.Name, w.name, w.Restart)
+			}
+		}
+	}
+	return nil
+}
+
+// RunWorkloads runs the workloads of the peers of cfg in their namespaces,
+// with delays measured from when it is called. It returns once every workload
+// not restarted always has exited for good, or once stop is closed. Workloads
+// still running then are sent SIGTERM, and killed if they do not exit within
+// ProcessGrace.
+//
+// The output of each workload goes to <peer>/<name>.stdout and .stderr in
+// logDir, or is discarded if logDir is empty.
+func (r *RenderedNetwork) RunWorkloads(cfg *Config, logDir string, stop <-chan struct{}) ([]*WorkloadResult, error) {
+	if err := cfg.validateWorkloads(); err != nil {
+		return nil, err
+	}
+
+	type job struct {
+		peer           string
+		w              *Workload
+		res            *WorkloadResult
+		stdout, stderr *os.File
+	}
+	var jobs []job
+	defer func() {
+		for _, j := range jobs {
+			if j.stdout != nil {
+				j.stdout.Close()
+				j.stderr.Close()
+			}
+		}
+	}()
+
+	for _, p := range cfg.Peers {
+		for i := range p.Workloads {
+			w := &p.Workloads[i]
+			j := job{peer: p.Name, w: w, res: &WorkloadResult{Peer: p.Name, Name: w.name, Command: w.Command}}
+			if logDir != "" {
+				var err error
+				if j.stdout, j.stderr, err = createLogs(logDir, p.Name, w.name); err != nil {
+					return nil, err
+				}
+			}
+			jobs = append(jobs, j)
+		}
+	}
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+
+	stopping := make(chan struct{})
+	// Without workloads that finish, finished is never closed and only
+	// stop ends the run.
+	finished := make(chan struct{})
+	var all, finite sync.WaitGroup
+	nfinite := 0
+	for _, j := range jobs {
+		j := j
+		once := j.w.Restart != RestartAlways
+		if once {
+			nfinite++
+			finite.Add(1)
+		}
+		all.Add(1)
+		go func() {
+			defer all.Done()
+			r.runWorkload(j.peer, j.w, j.res, j.stdout, j.stderr, stopping)
+			if once {
+				finite.Done()
+			}
+		}()
+	}
+	if nfinite > 0 {
+		go func() {
+			finite.Wait()
+			close(finished)
+		}()
+	}
+
+	select {
+	case <-finished:
+	case <-stop:
+	}
+	close(stopping)
+	all.Wait()
+
+	results := make([]*WorkloadResult, len(jobs))
+	for i, j := range jobs {
+		results[i] = j.res
+	}
+	return results, nil
+}
+
+// createLogs creates the files for the output of a workload.
+func createLogs(dir, peer, name string) (stdout, stderr *os.File, err error) {
+	if err := os.MkdirAll(filepath.Join(dir, peer), 0755); err != nil {
+		return nil, nil, err
+	}
+	if stdout, err = os.Create(filepath.Join(dir, peer, name+".stdout")); err != nil {
+		return nil, nil, err
+	}
+	if stderr, err = os.Create(filepath.Join(dir, peer, name+".stderr")); err != nil {
+		stdout.Close()
+		return nil, nil, err
+	}
+	return stdout, stderr, nil
+}
+
+// runWorkload runs a workload, restarting it as its policy says, until it
+// exits for good or stopping is closed.
+func (r *RenderedNetwork) runWorkload(peer string, w *Workload, res *WorkloadResult, stdout, stderr *os.File, stopping <-chan struct{}) {
+	delay := w.delay
+	for {
+		wait := time.NewTimer(delay)
+		select {
+		case <-wait.C:
+		case <-stopping:
+			wait.Stop()
+			return
+		}
+
+		p, err := r.startWorkload(peer, w, stdout, stderr)
+		if err != nil {
+			res.Error = err.Error()
+			return
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- p.Wait() }()
+		select {
+		case err = <-done:
+		case <-stopping:
+			p.Signal(syscall.SIGTERM)
+			select {
+			case err = <-done:
+			case <-time.After(ProcessGrace):
+				p.Kill()
+				err = <-done
+			}
+			res.Stopped = true
+		}
+
+		code := 0
+		if ee, ok := err.(*exec.ExitError); ok {
+			code = ee.ExitCode()
+		} else if err != nil {
+			code = -1
+		}
+		res.ExitCodes = append(res.ExitCodes, code)
+
+		if res.Stopped || w.Restart == "" || w.Restart == RestartNever || w.Restart == RestartOnFailure && code == 0 {
+			return
+		}
+		delay = RestartDelay
+	}
+}
+
+// startWorkload starts one run of a workload, with its output going to stdout
+// and stderr if they are not nil.
+func (r *RenderedNetwork) startWorkload(peer string, w *Workload, stdout, stderr *os.File) (*Process, error) {
+	cmd, err := r.Command(peer, w.Command[0], w.Command[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = os.Environ()
+	for _, k := range sortedKeys(w.Env) {
+		cmd.Env = append(cmd.Env, k+"="+w.Env[k])
+	}
+	if stdout != nil {
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+	}
+	return r.startCmd(peer, w.Command, cmd)
+}
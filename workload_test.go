@@ -0,0 +1,131 @@
+package netdef
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeIP puts an ip command on the PATH that runs "ip netns exec <ns>
+// <command>" as just the command, so workloads run without namespaces. The
+// returned function restores the PATH.
+func fakeIP(t *testing.T) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "netdef-ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\nshift 3\nexec \"$@\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "ip"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func workloadNetwork(t *testing.T, workloads ...Workload) (*RenderedNetwork, *Config) {
+	cfg := testConfig()
+	cfg.Networks = []Network{{Name: "lan", IpRange: "10.0.0.0/24"}}
+	cfg.Peers = []Peer{{Name: "a", Links: map[string]*LinkOpts{"lan": nil}, Workloads: workloads}}
+	r, _ := renderFake(t, cfg)
+	return r, cfg
+}
+
+func TestRunWorkloads(t *testing.T) {
+	defer fakeIP(t)()
+	r, cfg := workloadNetwork(t,
+		Workload{Command: []string{"true"}},
+		Workload{Name: "fail", Command: []string{"sh", "-c", "echo out; echo $V >&2; exit 3"}, Env: map[string]string{"V": "err"}},
+	)
+	logs, err := ioutil.TempDir("", "netdef-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logs)
+
+	results, err := r.RunWorkloads(cfg, logs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*WorkloadResult{
+		{Peer: "a", Name: "true", Command: []string{"true"}, ExitCodes: []int{0}},
+		{Peer: "a", Name: "fail", Command: cfg.Peers[0].Workloads[1].Command, ExitCodes: []int{3}},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got results %+v %+v, want %+v %+v", results[0], results[1], want[0], want[1])
+	}
+	if results[0].Failed() || !results[1].Failed() {
+		t.Errorf("got failed %v and %v, want false and true", results[0].Failed(), results[1].Failed())
+	}
+	for name, want := range map[string]string{"fail.stdout": "out\n", "fail.stderr": "err\n", "true.stdout": ""} {
+		got, err := ioutil.ReadFile(filepath.Join(logs, "a", name))
+		if err != nil || string(got) != want {
+			t.Errorf("got %s %q (%v), want %q", name, got, err, want)
+		}
+	}
+	if len(r.Processes) != 0 {
+		t.Errorf("got processes %+v after the run", r.Processes)
+	}
+}
+
+func TestRunWorkloadsRestart(t *testing.T) {
+	defer fakeIP(t)()
+	defer func(d time.Duration) { RestartDelay = d }(RestartDelay)
+	RestartDelay = 10 * time.Millisecond
+
+	count, err := ioutil.TempFile("", "netdef-count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count.Close()
+	defer os.Remove(count.Name())
+	// Fails on the first two runs.
+	script := `n=$(($(cat "$0") + 1)); echo $n > "$0"; [ $n -ge 3 ]`
+
+	r, cfg := workloadNetwork(t,
+		Workload{Name: "flaky", Command: []string{"sh", "-c", script, count.Name()}, Restart: RestartOnFailure},
+	)
+	results, err := r.RunWorkloads(cfg, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := results[0].ExitCodes; !reflect.DeepEqual(got, []int{1, 1, 0}) {
+		t.Errorf("got exit codes %v, want [1 1 0]", got)
+	}
+	if results[0].Failed() {
+		t.Error("workload that succeeded in the end failed")
+	}
+}
+
+func TestRunWorkloadsStop(t *testing.T) {
+	defer fakeIP(t)()
+	r, cfg := workloadNetwork(t,
+		Workload{Name: "server", Command: []string{"sleep", "60"}, Restart: RestartAlways},
+		Workload{Name: "late", Command: []string{"true"}, Delay: "1h"},
+	)
+
+	stop := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(stop) })
+	start := time.Now()
+	results, err := r.RunWorkloads(cfg, "", stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("took %s to stop", d)
+	}
+
+	if res := results[0]; !res.Stopped || !reflect.DeepEqual(res.ExitCodes, []int{-1}) || res.Failed() {
+		t.Errorf("got result %+v for the stopped workload", res)
+	}
+	if res := results[1]; len(res.ExitCodes) != 0 || res.Failed() {
+		t.Errorf("got result %+v for the workload that never started", res)
+	}
+}